@@ -3,9 +3,15 @@ package main
 import (
 	"flag"
 	"github.com/gorilla/mux"
+	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
 	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kfunc"
+	"github.com/kubefy/kubefy-server/pkg/kube"
+	"github.com/kubefy/kubefy-server/pkg/plan"
 	restcall "github.com/kubefy/kubefy-server/pkg/rest"
 
 	"github.com/golang/glog"
@@ -13,6 +19,8 @@ import (
 	//metaV1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	serving_clientset "github.com/knative/serving/pkg/client/clientset/versioned"
 	rook_clientset "github.com/rook/rook/pkg/client/clientset/versioned"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 
 	"k8s.io/client-go/rest"
@@ -24,8 +32,14 @@ const (
 )
 
 var (
-	namespace  string
-	kubeConfig string
+	namespace      string
+	kubeConfig     string
+	adminTokenFile string
+	plansFile      string
+	rolloutPeriod  time.Duration
+
+	installTemplates bool
+	maxSourceSize    string
 )
 
 func main() {
@@ -34,10 +48,61 @@ func main() {
 	flag.StringVar(&cfg.BuildTemplate, "build-template", "", "Knative build template")
 	flag.StringVar(&cfg.RookCephCluster, "rook-ceph-cluster", "rook-ceph", "Rook Ceph cluster namespace")
 	flag.StringVar(&cfg.RookCephObjectStore, "rook-ceph-object-store", "", "Rook Ceph Object Store name")
+	flag.StringVar(&cfg.DockerRegistry, "docker-registry", "https://index.docker.io/v1/", "Default registry of user docker credentials")
+	flag.StringVar(&cfg.GitHost, "git-host", "github.com", "Default host of user git credentials")
+	flag.StringVar(&plansFile, "plans-file", "", "YAML file of tenant plans, built-in free and pro plans are used if empty")
+	flag.StringVar(&cfg.NetworkAllowlist, "network-allowlist", "", "Space separated namespace[/key=value,...] peers allowed to reach user namespaces (ingress), e.g. monitoring/app=prometheus")
+	flag.StringVar(&cfg.EgressAllowlist, "egress-allowlist", "", "Space separated namespace[/key=value,...] peers user namespaces may reach (egress), e.g. databases/app=postgres; only applies with -cluster-cidrs, egress is open otherwise. The object store gateway is always allowed so that builds can fetch uploaded sources")
+	flag.StringVar(&cfg.ClusterCIDRs, "cluster-cidrs", "", "Space separated pod and service CIDRs, enables egress isolation of user namespaces")
+	flag.StringVar(&cfg.KubeAPIServer, "kube-api-server", "", "Kubernetes API server URL put in user kubeconfigs, defaults to the server's own")
+	flag.DurationVar(&rolloutPeriod, "rollout-sync-period", 30*time.Second, "How often progressive rollouts are checked and stepped")
+	flag.BoolVar(&installTemplates, "install-build-templates", false, "Install or upgrade the buildah, kaniko and buildpacks ClusterBuildTemplates at startup")
+	flag.StringVar(&cfg.ContainerRegistry, "container-registry", "", "Registry of the images built from source when the function has no image, e.g. registry.example.com; without it or -registry-service such functions need an image")
+	flag.StringVar(&cfg.RegistryService, "registry-service", "", "namespace/name of an in-cluster registry Service used instead of container-registry")
+	flag.StringVar(&maxSourceSize, "max-source-size", "100Mi", "Largest source archive that can be uploaded, as a quantity")
+	flag.StringVar(&cfg.SourceFetchImage, "source-fetch-image", "busybox:1.30", "Image of the build step that fetches uploaded source archives, needs sh, wget, sha256sum, tar and unzip")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "File holding the admin API token")
 	flag.Parse()
 	flag.Set("logtostderr", "true")
 
+	if len(adminTokenFile) > 0 {
+		token, err := ioutil.ReadFile(adminTokenFile)
+		if err != nil {
+			glog.Fatal(err.Error())
+		}
+		cfg.AdminToken = strings.TrimSpace(string(token))
+	}
+	if _, err := kube.ParseNetworkPeers(cfg.NetworkAllowlist); err != nil {
+		glog.Fatal(err.Error())
+	}
+	if _, err := kube.ParseNetworkPeers(cfg.EgressAllowlist); err != nil {
+		glog.Fatal(err.Error())
+	}
+	size, err := resource.ParseQuantity(maxSourceSize)
+	if err != nil || size.Sign() <= 0 {
+		glog.Fatalf("invalid max-source-size %q", maxSourceSize)
+	}
+	cfg.MaxSourceSize = size.Value()
+	if len(plansFile) > 0 {
+		if err := plan.Load(plansFile); err != nil {
+			glog.Fatal(err.Error())
+		}
+	}
+
 	initClients()
+	if installTemplates {
+		if err := kfunc.InstallTemplates(); err != nil {
+			glog.Fatal(err.Error())
+		}
+		if reports, err := kfunc.TemplateReport(); err != nil {
+			glog.Warningf("failed to report build templates: %v", err)
+		} else {
+			for _, r := range reports {
+				glog.Infof("build template %s compatible %v, issues %v, notes %v", r.Name, r.Compatible, r.Issues, r.Notes)
+			}
+		}
+	}
+	go kfunc.ReconcileRollouts(rolloutPeriod, wait.NeverStop)
 	startServer()
 }
 
@@ -53,26 +118,75 @@ func initClients() {
 	if err != nil {
 		glog.Fatal(err.Error())
 	}
+	cfg.RestConfig = config
 	// create kube clientset
 	cfg.KubeClientset = kubernetes.NewForConfigOrDie(config)
 	// create serving clientset
 	cfg.ServingClientset = serving_clientset.NewForConfigOrDie(config)
 	// create rook clientset
 	cfg.RookClientset = rook_clientset.NewForConfigOrDie(config)
+	// create knative build client
+	if cfg.BuildClient, err = cfg.NewBuildClient(config); err != nil {
+		glog.Fatal(err.Error())
+	}
 }
 
 func startServer() {
 	router := mux.NewRouter()
 
 	router.HandleFunc("/", restcall.Root).Methods("GET")
-	router.HandleFunc("/users", restcall.CreateUser).Methods("POST")
-
-	router.HandleFunc("/functions", restcall.CreateFunction).Methods("POST")
-	router.HandleFunc("/functions", restcall.GetFunction).Methods("GET")
-	router.HandleFunc("/functions", restcall.DeleteFunction).Methods("DELETE")
 
-	router.HandleFunc("/storage", restcall.CreateStorage).Methods("POST")
-	//	router.HandleFunc("/storage", restcall.DeleteStorage).Methods("DELETE")
+	v1 := router.PathPrefix("/api/v1").Subrouter()
+	v1.HandleFunc("/users", restcall.CreateUser).Methods("POST")
+	v1.HandleFunc("/users", restcall.ListUsers).Methods("GET")
+	v1.HandleFunc("/users/{user}", restcall.GetUser).Methods("GET")
+	v1.HandleFunc("/users/{user}", restcall.DeleteUser).Methods("DELETE")
+	v1.HandleFunc("/users/{user}/kubeconfig", restcall.GetKubeconfig).Methods("GET")
+	v1.HandleFunc("/users/{user}/plan", restcall.SetUserPlan).Methods("PUT")
+	v1.HandleFunc("/users/{user}/token", restcall.IssueToken).Methods("POST")
+	v1.HandleFunc("/users/{user}/token", restcall.RevokeToken).Methods("DELETE")
+	v1.HandleFunc("/buildtemplates/report", restcall.BuildTemplateReport).Methods("GET")
+	v1.HandleFunc("/users/{user}/buildtemplates", restcall.ListBuildTemplates).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions", restcall.CreateFunction).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions", restcall.ListFunctions).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}", restcall.GetFunction).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}", restcall.UpdateFunction).Methods("PUT", "PATCH")
+	v1.HandleFunc("/users/{user}/functions/{function}", restcall.DeleteFunction).Methods("DELETE")
+	v1.HandleFunc("/users/{user}/functions/{function}/source", restcall.DeploySource).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions/{function}/revisions", restcall.ListRevisions).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/builds", restcall.ListBuilds).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/builds/{build}", restcall.GetBuild).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/builds/{build}/logs", restcall.StreamBuildLogs).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/replicas", restcall.GetReplicas).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout", restcall.GetRollout).Methods("GET")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout", restcall.SetRollout).Methods("PUT")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout/progressive", restcall.StartProgressiveRollout).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout/promote", restcall.PromoteRollout).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout/abort", restcall.AbortRollout).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollout/latest", restcall.RunLatest).Methods("POST")
+	v1.HandleFunc("/users/{user}/functions/{function}/rollback", restcall.Rollback).Methods("POST")
+	v1.HandleFunc("/users/{user}/buckets", restcall.CreateStorage).Methods("POST")
+	v1.HandleFunc("/users/{user}/buckets/{bucket}", restcall.DeleteBucket).Methods("DELETE")
+
+	// deprecated unversioned routes
+	router.HandleFunc("/users", restcall.Deprecated(restcall.CreateUser)).Methods("POST")
+	router.HandleFunc("/users", restcall.Deprecated(restcall.ListUsers)).Methods("GET")
+	router.HandleFunc("/users", restcall.Deprecated(restcall.DeleteUser)).Methods("DELETE")
+	router.HandleFunc("/users/{user}", restcall.Deprecated(restcall.GetUser)).Methods("GET")
+	router.HandleFunc("/users/{user}", restcall.Deprecated(restcall.DeleteUser)).Methods("DELETE")
+	router.HandleFunc("/users/{user}/kubeconfig", restcall.Deprecated(restcall.GetKubeconfig)).Methods("GET")
+	router.HandleFunc("/users/{user}/plan", restcall.Deprecated(restcall.SetUserPlan)).Methods("PUT")
+	router.HandleFunc("/users/{user}/token", restcall.Deprecated(restcall.IssueToken)).Methods("POST")
+	router.HandleFunc("/users/{user}/token", restcall.Deprecated(restcall.RevokeToken)).Methods("DELETE")
+
+	router.HandleFunc("/functions", restcall.Deprecated(restcall.CreateFunction)).Methods("POST")
+	router.HandleFunc("/functions", restcall.Deprecated(restcall.GetFunction)).Methods("GET")
+	router.HandleFunc("/functions", restcall.Deprecated(restcall.UpdateFunction)).Methods("PUT", "PATCH")
+	router.HandleFunc("/functions", restcall.Deprecated(restcall.DeleteFunction)).Methods("DELETE")
+
+	router.HandleFunc("/storage", restcall.Deprecated(restcall.CreateStorage)).Methods("POST")
+
+	router.Use(restcall.Authenticate)
 
 	glog.Fatal(http.ListenAndServe(":8888", router))
 }
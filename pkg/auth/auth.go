@@ -0,0 +1,144 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kube"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// TokenSecretName is the secret in the user namespace holding the token hash
+	TokenSecretName = "kubefy-api-token"
+	tokenHashKey    = "sha256"
+	tokenBytes      = 32
+)
+
+// ErrInvalidToken is returned for malformed, unknown and revoked tokens
+var ErrInvalidToken = fmt.Errorf("invalid token")
+
+type contextKey int
+
+const identityKey contextKey = 0
+
+// Identity is the caller a bearer token belongs to
+type Identity struct {
+	// Namespace is the only user namespace the caller may act on
+	Namespace string
+	// Admin callers may act on every namespace
+	Admin bool
+}
+
+// Allowed returns true if the identity may act on namespace
+func (id *Identity) Allowed(namespace string) bool {
+	if id == nil {
+		return false
+	}
+	return id.Admin || (len(namespace) != 0 && id.Namespace == namespace)
+}
+
+// WithIdentity returns a copy of ctx carrying id
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey, id)
+}
+
+// FromRequest returns the identity of an authenticated request, or nil
+func FromRequest(r *http.Request) *Identity {
+	id, _ := r.Context().Value(identityKey).(*Identity)
+	return id
+}
+
+// IssueToken creates a new token for the user namespace, replacing any
+// previous one. Only the token hash is stored.
+func IssueToken(namespace, userName string) (string, error) {
+	buf := make([]byte, tokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	// the namespace prefix tells Verify where to find the hash
+	token := namespace + "." + hex.EncodeToString(buf)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      TokenSecretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				kube.UserNameLabel: userName,
+			},
+		},
+		Data: map[string][]byte{
+			tokenHashKey: []byte(hash(token)),
+		},
+	}
+	secrets := cfg.KubeClientset.CoreV1().Secrets(namespace)
+	_, err := secrets.Create(secret)
+	if errors.IsAlreadyExists(err) {
+		_, err = secrets.Update(secret)
+	}
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RevokeToken deletes the token of the user namespace
+func RevokeToken(namespace string) error {
+	err := cfg.KubeClientset.CoreV1().Secrets(namespace).Delete(TokenSecretName, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Verify returns the identity of a bearer token
+func Verify(token string) (*Identity, error) {
+	if len(cfg.AdminToken) != 0 && subtle.ConstantTimeCompare([]byte(token), []byte(cfg.AdminToken)) == 1 {
+		return &Identity{Admin: true}, nil
+	}
+
+	i := strings.LastIndex(token, ".")
+	if i <= 0 {
+		return nil, ErrInvalidToken
+	}
+	namespace := token[:i]
+	secret, err := cfg.KubeClientset.CoreV1().Secrets(namespace).Get(TokenSecretName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, ErrInvalidToken
+		}
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(secret.Data[tokenHashKey], []byte(hash(token))) != 1 {
+		return nil, ErrInvalidToken
+	}
+	return &Identity{Namespace: namespace}, nil
+}
+
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -1,16 +1,50 @@
 package config
 
 import (
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
 	serving_clientset "github.com/knative/serving/pkg/client/clientset/versioned"
 	rook_clientset "github.com/rook/rook/pkg/client/clientset/versioned"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 var (
+	RestConfig          *rest.Config
 	KubeClientset       *kubernetes.Clientset
 	ServingClientset    *serving_clientset.Clientset
 	RookClientset       *rook_clientset.Clientset
+	BuildClient         rest.Interface
 	BuildTemplate       string
 	RookCephCluster     string
 	RookCephObjectStore string
+	AdminToken          string
+	DockerRegistry      string
+	GitHost             string
+	NetworkAllowlist    string
+	EgressAllowlist     string
+	ClusterCIDRs        string
+	KubeAPIServer       string
+	MaxSourceSize       int64
+	SourceFetchImage    string
+	ContainerRegistry   string
+	RegistryService     string
 )
+
+// NewBuildClient returns a REST client of the Knative build API group, which
+// has no vendored clientset
+func NewBuildClient(c *rest.Config) (*rest.RESTClient, error) {
+	scheme := runtime.NewScheme()
+	if err := build_api.AddToScheme(scheme); err != nil {
+		return nil, err
+	}
+	config := *c
+	config.GroupVersion = &build_api.SchemeGroupVersion
+	config.APIPath = "/apis"
+	config.NegotiatedSerializer = serializer.DirectCodecFactory{CodecFactory: serializer.NewCodecFactory(scheme)}
+	if len(config.UserAgent) == 0 {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	return rest.RESTClientFor(&config)
+}
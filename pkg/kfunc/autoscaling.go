@@ -0,0 +1,169 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"strconv"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/plan"
+
+	"github.com/knative/serving/pkg/apis/autoscaling"
+	"github.com/knative/serving/pkg/apis/serving"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var (
+	// autoscalingClasses maps the class names of the API to Knative classes
+	autoscalingClasses = map[string]string{
+		"kpa": autoscaling.KPA,
+		"hpa": autoscaling.HPA,
+	}
+)
+
+// Replicas returns the replica counts of the Revisions of a Knative Service
+func Replicas(namespace, funcName string) ([]model.RevisionReplicas, error) {
+	var (
+		replicas []model.RevisionReplicas
+	)
+	if len(funcName) == 0 {
+		return replicas, errors.NewBadRequest("function name is missing")
+	}
+	if _, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Get(funcName, metav1.GetOptions{}); err != nil {
+		return replicas, err
+	}
+	listOpts := metav1.ListOptions{LabelSelector: serving.ServiceLabelKey + "=" + funcName}
+	deploys, err := cfg.KubeClientset.AppsV1().Deployments(namespace).List(listOpts)
+	if err != nil {
+		return replicas, err
+	}
+	for _, d := range deploys.Items {
+		r := model.RevisionReplicas{
+			Revision:      d.Labels[serving.RevisionLabelKey],
+			Replicas:      d.Status.Replicas,
+			ReadyReplicas: d.Status.ReadyReplicas,
+		}
+		if d.Spec.Replicas != nil {
+			r.Desired = *d.Spec.Replicas
+		}
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+// checkAutoscaling validates the autoscaling settings of a request against the plan
+func checkAutoscaling(a *model.Autoscaling, p *plan.Plan) error {
+	if a == nil {
+		return nil
+	}
+	if (a.MinScale != nil && *a.MinScale < 0) || (a.MaxScale != nil && *a.MaxScale < 0) {
+		return errors.NewBadRequest("minScale and maxScale must not be negative")
+	}
+	if a.Target != nil && *a.Target < 1 {
+		return errors.NewBadRequest("target must be at least 1")
+	}
+	if len(a.Class) > 0 {
+		if _, ok := autoscalingClasses[a.Class]; !ok {
+			return errors.NewBadRequest(fmt.Sprintf("invalid autoscaling class %q, must be kpa or hpa", a.Class))
+		}
+		// the hpa never scales to zero
+		if a.Class == "hpa" && p.MaxMinScale < 1 {
+			return errors.NewBadRequest(fmt.Sprintf("plan %s only allows the kpa class", p.Name))
+		}
+	}
+	return p.CheckScale(a.MinScale, a.MaxScale)
+}
+
+// applyAutoscaling sets the autoscaling annotations of a revision template
+// for the fields of a that are set
+func applyAutoscaling(t *serving_api.RevisionTemplateSpec, a *model.Autoscaling) error {
+	if t.Annotations == nil {
+		t.Annotations = map[string]string{}
+	}
+	if a.MinScale != nil {
+		t.Annotations[autoscaling.MinScaleAnnotationKey] = strconv.Itoa(int(*a.MinScale))
+	}
+	if a.MaxScale != nil {
+		t.Annotations[autoscaling.MaxScaleAnnotationKey] = strconv.Itoa(int(*a.MaxScale))
+	}
+	if a.Target != nil {
+		t.Annotations[autoscaling.TargetAnnotationKey] = strconv.Itoa(int(*a.Target))
+	}
+	if len(a.Class) > 0 {
+		t.Annotations[autoscaling.ClassAnnotationKey] = autoscalingClasses[a.Class]
+		if a.Class == "hpa" {
+			t.Annotations[autoscaling.MetricAnnotationKey] = autoscaling.CPU
+		} else {
+			t.Annotations[autoscaling.MetricAnnotationKey] = autoscaling.Concurrency
+		}
+	}
+
+	// check the merged bounds, a PATCH may only change one of them
+	merged := autoscalingOf(t)
+	if merged.MinScale != nil && merged.MaxScale != nil && *merged.MaxScale > 0 && *merged.MinScale > *merged.MaxScale {
+		return errors.NewBadRequest(fmt.Sprintf("minScale %d is above maxScale %d", *merged.MinScale, *merged.MaxScale))
+	}
+	if merged.Class == "hpa" && (merged.MinScale == nil || *merged.MinScale < 1) {
+		return errors.NewBadRequest("the hpa class needs minScale of at least 1")
+	}
+	return nil
+}
+
+// autoscalingOf returns the autoscaling settings of a revision template, nil if none is set
+func autoscalingOf(t *serving_api.RevisionTemplateSpec) *model.Autoscaling {
+	var (
+		a   model.Autoscaling
+		set bool
+	)
+	for key, value := range map[string]**int32{
+		autoscaling.MinScaleAnnotationKey: &a.MinScale,
+		autoscaling.MaxScaleAnnotationKey: &a.MaxScale,
+		autoscaling.TargetAnnotationKey:   &a.Target,
+	} {
+		if s, ok := t.Annotations[key]; ok {
+			if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+				v := int32(i)
+				*value = &v
+				set = true
+			}
+		}
+	}
+	for name, class := range autoscalingClasses {
+		if t.Annotations[autoscaling.ClassAnnotationKey] == class {
+			a.Class = name
+			set = true
+		}
+	}
+	if !set {
+		return nil
+	}
+	return &a
+}
+
+// clearAutoscaling drops the autoscaling annotations of a revision template
+func clearAutoscaling(t *serving_api.RevisionTemplateSpec) {
+	for _, key := range []string{
+		autoscaling.MinScaleAnnotationKey,
+		autoscaling.MaxScaleAnnotationKey,
+		autoscaling.TargetAnnotationKey,
+		autoscaling.ClassAnnotationKey,
+		autoscaling.MetricAnnotationKey,
+	} {
+		delete(t.Annotations, key)
+	}
+}
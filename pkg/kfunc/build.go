@@ -0,0 +1,242 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"bufio"
+	"fmt"
+	"strings"
+	"time"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	// buildStepPrefix prefixes the init containers that run the build steps
+	buildStepPrefix = "build-step-"
+	// maxLogLine is the longest build log line that is streamed
+	maxLogLine = 1024 * 1024
+)
+
+// Builds returns the status of the Builds of a Knative Service
+func Builds(namespace, funcName string) ([]model.Build, error) {
+	var (
+		builds []model.Build
+	)
+	resources, err := Resources(namespace, funcName)
+	if err != nil {
+		return builds, err
+	}
+	for _, name := range resources.Builds {
+		b, err := getBuild(namespace, name)
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return builds, err
+		}
+		build, err := buildOf(b)
+		if err != nil {
+			return builds, err
+		}
+		builds = append(builds, build)
+	}
+	return builds, nil
+}
+
+// GetBuild returns the status of a Build of a Knative Service
+func GetBuild(namespace, funcName, buildName string) (model.Build, error) {
+	b, err := functionBuild(namespace, funcName, buildName)
+	if err != nil {
+		return model.Build{Name: buildName}, err
+	}
+	return buildOf(b)
+}
+
+// StreamBuildLogs sends the log lines of each step of a Build in order,
+// following the running step until the build ends or stop is closed
+func StreamBuildLogs(namespace, funcName, buildName string, stop <-chan struct{}, send func(step, line string) error) error {
+	b, err := functionBuild(namespace, funcName, buildName)
+	if err != nil {
+		return err
+	}
+	// wait for the build pod to be scheduled
+	err = wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		if b.Status.Cluster != nil && len(b.Status.Cluster.PodName) > 0 {
+			return true, nil
+		}
+		if c := b.Status.GetCondition(build_api.BuildSucceeded); c != nil && !c.IsUnknown() {
+			return false, fmt.Errorf("build %s ended without a pod: %s", buildName, c.Message)
+		}
+		b, err = getBuild(namespace, buildName)
+		return false, err
+	}, stop)
+	if err != nil {
+		return err
+	}
+
+	pods := cfg.KubeClientset.CoreV1().Pods(namespace)
+	podName := b.Status.Cluster.PodName
+	pod, err := pods.Get(podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for _, c := range pod.Spec.InitContainers {
+		step := strings.TrimPrefix(c.Name, buildStepPrefix)
+		// wait for the step to start, later steps never start once one failed
+		started := false
+		err = wait.PollImmediateUntil(time.Second, func() (bool, error) {
+			pod, err = pods.Get(podName, metav1.GetOptions{})
+			if err != nil {
+				return false, err
+			}
+			for _, cs := range pod.Status.InitContainerStatuses {
+				if cs.Name == c.Name && (cs.State.Running != nil || cs.State.Terminated != nil) {
+					started = true
+					return true, nil
+				}
+			}
+			return pod.Status.Phase == corev1.PodFailed || pod.Status.Phase == corev1.PodSucceeded, nil
+		}, stop)
+		if err != nil {
+			return err
+		}
+		if !started {
+			return nil
+		}
+
+		logs, err := pods.GetLogs(podName, &corev1.PodLogOptions{Container: c.Name, Follow: true}).Stream()
+		if err != nil {
+			return err
+		}
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-stop:
+				logs.Close()
+			case <-done:
+			}
+		}()
+		scanner := bufio.NewScanner(logs)
+		scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+		for scanner.Scan() {
+			if err = send(step, scanner.Text()); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = scanner.Err()
+		}
+		close(done)
+		logs.Close()
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// functionBuild returns a Build after checking that it belongs to the Knative Service
+func functionBuild(namespace, funcName, buildName string) (*build_api.Build, error) {
+	resources, err := Resources(namespace, funcName)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range resources.Builds {
+		if name == buildName {
+			return getBuild(namespace, buildName)
+		}
+	}
+	return nil, errors.NewNotFound(build_api.Resource("builds"), buildName)
+}
+
+func getBuild(namespace, name string) (*build_api.Build, error) {
+	b := &build_api.Build{}
+	err := cfg.BuildClient.Get().Namespace(namespace).Resource("builds").Name(name).Do().Into(b)
+	return b, err
+}
+
+// buildOf returns the status of a Build with the state of each step
+func buildOf(b *build_api.Build) (model.Build, error) {
+	build := model.Build{
+		Name:       b.Name,
+		Succeeded:  string(corev1.ConditionUnknown),
+		Conditions: conditionsOf(b.Status.Conditions),
+	}
+	if c := b.Status.GetCondition(build_api.BuildSucceeded); c != nil {
+		build.Succeeded = string(c.Status)
+	}
+	if t := b.Status.StartTime; t != nil {
+		build.StartTime = t.UTC().Format(time.RFC3339)
+		end := time.Now()
+		if c := b.Status.CompletionTime; c != nil {
+			build.CompletionTime = c.UTC().Format(time.RFC3339)
+			end = c.Time
+		}
+		build.Duration = end.Sub(t.Time).Round(time.Second).String()
+	}
+	if b.Status.Cluster == nil || len(b.Status.Cluster.PodName) == 0 {
+		for i, state := range b.Status.StepStates {
+			build.Steps = append(build.Steps, buildStepOf(fmt.Sprintf("step-%d", i), state))
+		}
+		return build, nil
+	}
+
+	build.PodName = b.Status.Cluster.PodName
+	pod, err := cfg.KubeClientset.CoreV1().Pods(b.Namespace).Get(build.PodName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// the pod of an old build may be gone
+		for i, state := range b.Status.StepStates {
+			build.Steps = append(build.Steps, buildStepOf(fmt.Sprintf("step-%d", i), state))
+		}
+		return build, nil
+	}
+	if err != nil {
+		return build, err
+	}
+	for _, cs := range pod.Status.InitContainerStatuses {
+		build.Steps = append(build.Steps, buildStepOf(strings.TrimPrefix(cs.Name, buildStepPrefix), cs.State))
+	}
+	return build, nil
+}
+
+func buildStepOf(name string, state corev1.ContainerState) model.BuildStep {
+	step := model.BuildStep{Name: name, State: "waiting"}
+	switch {
+	case state.Terminated != nil:
+		t := state.Terminated
+		step.State = "terminated"
+		step.Reason, step.Message, step.ExitCode = t.Reason, t.Message, t.ExitCode
+		step.StartedAt = t.StartedAt.UTC().Format(time.RFC3339)
+		step.FinishedAt = t.FinishedAt.UTC().Format(time.RFC3339)
+	case state.Running != nil:
+		step.State = "running"
+		step.StartedAt = state.Running.StartedAt.UTC().Format(time.RFC3339)
+	case state.Waiting != nil:
+		step.Reason, step.Message = state.Waiting.Reason, state.Waiting.Message
+	}
+	return step
+}
@@ -0,0 +1,261 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// catalogVersion is bumped whenever a catalog template changes, so that
+	// installed copies get upgraded
+	catalogVersion           = "2"
+	catalogLabel             = "kubefy.io/catalog"
+	catalogVersionAnnotation = "kubefy.io/catalog-version"
+	// buildahImage is fixed rather than a parameter since the buildah steps
+	// run privileged
+	buildahImage = "quay.io/buildah/stable:v1.7"
+)
+
+var (
+	templateParamRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	privileged       = true
+)
+
+// catalog returns the ClusterBuildTemplates kubefy can install
+func catalog() []build_api.ClusterBuildTemplate {
+	str := func(s string) *string { return &s }
+	return []build_api.ClusterBuildTemplate{
+		catalogTemplate("buildah", build_api.BuildTemplateSpec{
+			Parameters: []build_api.ParameterSpec{
+				{Name: imageParameter, Description: "The name of the image to push"},
+				{Name: "DOCKERFILE", Description: "Path to the Dockerfile", Default: str("./Dockerfile")},
+				{Name: "TLSVERIFY", Description: "Verify the TLS of the registry", Default: str("true")},
+			},
+			Steps: []corev1.Container{
+				{
+					Name:            "build",
+					Image:           buildahImage,
+					WorkingDir:      "/workspace",
+					Command:         []string{"buildah", "bud", "--tls-verify=${TLSVERIFY}", "--layers", "-f", "${DOCKERFILE}", "-t", "${IMAGE}", "."},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "varlibcontainers", MountPath: "/var/lib/containers"}},
+					SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+				},
+				{
+					Name:            "push",
+					Image:           buildahImage,
+					Command:         []string{"buildah", "push", "--tls-verify=${TLSVERIFY}", "${IMAGE}", "docker://${IMAGE}"},
+					VolumeMounts:    []corev1.VolumeMount{{Name: "varlibcontainers", MountPath: "/var/lib/containers"}},
+					SecurityContext: &corev1.SecurityContext{Privileged: &privileged},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{Name: "varlibcontainers", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+		}),
+		catalogTemplate("kaniko", build_api.BuildTemplateSpec{
+			Parameters: []build_api.ParameterSpec{
+				{Name: imageParameter, Description: "The name of the image to push"},
+				{Name: "DOCKERFILE", Description: "Path to the Dockerfile", Default: str("/workspace/Dockerfile")},
+				{Name: "CONTEXT", Description: "Path to the build context", Default: str("/workspace")},
+			},
+			Steps: []corev1.Container{
+				{
+					Name:  "build-and-push",
+					Image: "gcr.io/kaniko-project/executor:v0.9.0",
+					Args:  []string{"--dockerfile=${DOCKERFILE}", "--context=${CONTEXT}", "--destination=${IMAGE}"},
+					Env:   []corev1.EnvVar{{Name: "DOCKER_CONFIG", Value: "/builder/home/.docker"}},
+				},
+			},
+		}),
+		catalogTemplate("buildpacks", build_api.BuildTemplateSpec{
+			Parameters: []build_api.ParameterSpec{
+				{Name: imageParameter, Description: "The name of the image to push"},
+				{Name: "BUILDER_IMAGE", Description: "The Cloud Native Buildpacks builder", Default: str("cloudfoundry/cnb:bionic")},
+				{Name: "RUN_IMAGE", Description: "The base image of the function", Default: str("packs/run:v3alpha2")},
+				{Name: "USE_CRED_HELPERS", Description: "Use the registry credential helpers", Default: str("true")},
+			},
+			Steps: []corev1.Container{
+				{
+					Name:         "prepare",
+					Image:        "alpine:3.9",
+					Command:      []string{"/bin/sh"},
+					Args:         []string{"-c", "chown -R 1000:1000 /workspace /layers /cache /builder/home"},
+					VolumeMounts: []corev1.VolumeMount{{Name: "layers-dir", MountPath: "/layers"}, {Name: "cache", MountPath: "/cache"}},
+				},
+				buildpacksStep("detect", "/lifecycle/detector", "-app=/workspace", "-group=/layers/group.toml", "-plan=/layers/plan.toml"),
+				buildpacksStep("analyze", "/lifecycle/analyzer", "-layers=/layers", "-helpers=${USE_CRED_HELPERS}", "-group=/layers/group.toml", "${IMAGE}"),
+				buildpacksStep("build", "/lifecycle/builder", "-layers=/layers", "-app=/workspace", "-group=/layers/group.toml", "-plan=/layers/plan.toml"),
+				buildpacksStep("export", "/lifecycle/exporter", "-layers=/layers", "-helpers=${USE_CRED_HELPERS}", "-app=/workspace", "-image=${RUN_IMAGE}", "-group=/layers/group.toml", "${IMAGE}"),
+			},
+			Volumes: []corev1.Volume{
+				{Name: "layers-dir", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+				{Name: "cache", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			},
+		}),
+	}
+}
+
+func buildpacksStep(name, command string, args ...string) corev1.Container {
+	return corev1.Container{
+		Name:         name,
+		Image:        "${BUILDER_IMAGE}",
+		Command:      []string{command},
+		Args:         args,
+		VolumeMounts: []corev1.VolumeMount{{Name: "layers-dir", MountPath: "/layers"}, {Name: "cache", MountPath: "/cache"}},
+	}
+}
+
+func catalogTemplate(name string, spec build_api.BuildTemplateSpec) build_api.ClusterBuildTemplate {
+	return build_api.ClusterBuildTemplate{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: build_api.SchemeGroupVersion.String(),
+			Kind:       string(build_api.ClusterBuildTemplateKind),
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{catalogLabel: "true"},
+			Annotations: map[string]string{catalogVersionAnnotation: catalogVersion},
+		},
+		Spec: spec,
+	}
+}
+
+// InstallTemplates creates the catalog ClusterBuildTemplates that are missing
+// and upgrades the ones kubefy installed before. Templates of the same name
+// that were not installed by kubefy are left alone.
+func InstallTemplates() error {
+	client := cfg.BuildClient
+	for _, t := range catalog() {
+		var current build_api.ClusterBuildTemplate
+		err := client.Get().Resource("clusterbuildtemplates").Name(t.Name).Do().Into(&current)
+		if errors.IsNotFound(err) {
+			if err = client.Post().Resource("clusterbuildtemplates").Body(&t).Do().Error(); err != nil {
+				return err
+			}
+			glog.Infof("installed build template %s", t.Name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if current.Labels[catalogLabel] != "true" {
+			glog.Infof("build template %s is not managed by kubefy, not upgrading it", t.Name)
+			continue
+		}
+		if current.Annotations[catalogVersionAnnotation] == catalogVersion {
+			continue
+		}
+		t.ResourceVersion = current.ResourceVersion
+		if err = client.Put().Resource("clusterbuildtemplates").Name(t.Name).Body(&t).Do().Error(); err != nil {
+			return err
+		}
+		glog.Infof("upgraded build template %s to catalog version %s", t.Name, catalogVersion)
+	}
+	return nil
+}
+
+// TemplateReport reports how well the ClusterBuildTemplates, and the catalog
+// templates that are not installed, fit what kfunc passes to them
+func TemplateReport() ([]model.TemplateReport, error) {
+	var (
+		reports []model.TemplateReport
+		cbts    build_api.ClusterBuildTemplateList
+	)
+	if err := cfg.BuildClient.Get().Resource("clusterbuildtemplates").Do().Into(&cbts); err != nil {
+		return reports, err
+	}
+	installed := map[string]*build_api.ClusterBuildTemplate{}
+	for i := range cbts.Items {
+		installed[cbts.Items[i].Name] = &cbts.Items[i]
+	}
+	catalogued := map[string]build_api.ClusterBuildTemplate{}
+	for _, t := range catalog() {
+		catalogued[t.Name] = t
+		if _, ok := installed[t.Name]; !ok {
+			report := reportTemplate(t.Name, t.Spec)
+			report.CatalogVersion = catalogVersion
+			report.Notes = append(report.Notes, "not installed, start kubefy with --install-build-templates")
+			reports = append(reports, report)
+		}
+	}
+	for name, t := range installed {
+		report := reportTemplate(name, t.Spec)
+		report.Installed = true
+		report.Managed = t.Labels[catalogLabel] == "true"
+		report.CatalogVersion = t.Annotations[catalogVersionAnnotation]
+		if c, ok := catalogued[name]; ok && report.Managed && !reflect.DeepEqual(c.Spec, t.Spec) {
+			report.Notes = append(report.Notes, "differs from the kubefy catalog")
+		}
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].Name < reports[j].Name
+	})
+	return reports, nil
+}
+
+// reportTemplate checks the parameters and builder images of a template
+func reportTemplate(templateName string, spec build_api.BuildTemplateSpec) model.TemplateReport {
+	report := model.TemplateReport{Name: templateName, Kind: string(build_api.ClusterBuildTemplateKind)}
+	defaults := map[string]string{}
+	hasImage := false
+	for _, p := range spec.Parameters {
+		switch {
+		case p.Name == imageParameter:
+			hasImage = true
+		case p.Default == nil:
+			report.Issues = append(report.Issues, fmt.Sprintf("parameter %s has no default, functions must pass it in buildArguments", p.Name))
+		default:
+			defaults[p.Name] = *p.Default
+		}
+	}
+	if !hasImage {
+		report.Issues = append(report.Issues, fmt.Sprintf("no %s parameter, kfunc cannot set the function image", imageParameter))
+	}
+	for _, step := range spec.Steps {
+		image := templateParamRef.ReplaceAllStringFunc(step.Image, func(ref string) string {
+			if v, ok := defaults[templateParamRef.FindStringSubmatch(ref)[1]]; ok {
+				return v
+			}
+			return ref
+		})
+		report.Images = append(report.Images, image)
+		if strings.Contains(image, "${") {
+			report.Notes = append(report.Notes, fmt.Sprintf("step %s image %s depends on a build argument", step.Name, step.Image))
+		} else if _, err := name.ParseReference(image, name.WeakValidation); err != nil {
+			report.Issues = append(report.Issues, fmt.Sprintf("step %s image %s is invalid: %v", step.Name, image, err))
+		}
+		if sc := step.SecurityContext; sc != nil && sc.Privileged != nil && *sc.Privileged {
+			report.Notes = append(report.Notes, fmt.Sprintf("step %s runs privileged", step.Name))
+		}
+	}
+	report.Compatible = len(report.Issues) == 0
+	return report
+}
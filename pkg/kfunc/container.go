@@ -0,0 +1,373 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"strings"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/plan"
+
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// maskedValue replaces values that come from Secrets
+	maskedValue = "******"
+)
+
+// GetContainer returns the user settable part of the container of a Knative Service
+func GetContainer(namespace, funcName string) (model.ContainerSpec, error) {
+	if len(funcName) == 0 {
+		return model.ContainerSpec{}, errors.NewBadRequest("function name is missing")
+	}
+	svc, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Get(funcName, metav1.GetOptions{})
+	if err != nil {
+		return model.ContainerSpec{}, err
+	}
+	config := configurationOf(svc)
+	if config == nil {
+		return model.ContainerSpec{}, nil
+	}
+	return containerSpecOf(&config.RevisionTemplate), nil
+}
+
+// validateContainerSpec checks the container of a function against the plan
+// of the namespace, and that the Secrets and ConfigMaps it refers to exist
+func validateContainerSpec(namespace string, spec model.ContainerSpec) error {
+	if spec.Resources != nil || spec.Autoscaling != nil {
+		p, err := plan.ForNamespace(namespace)
+		if err != nil {
+			return err
+		}
+		if err = checkResources(spec.Resources, p); err != nil {
+			return err
+		}
+		if err = checkAutoscaling(spec.Autoscaling, p); err != nil {
+			return err
+		}
+	}
+	if len(spec.Protocol) > 0 && spec.Protocol != "http1" && spec.Protocol != "h2c" {
+		return errors.NewBadRequest(fmt.Sprintf("invalid protocol %q, must be http1 or h2c", spec.Protocol))
+	}
+
+	names := map[string]bool{}
+	for _, env := range spec.Env {
+		if msgs := validation.IsEnvVarName(env.Name); len(msgs) > 0 {
+			return errors.NewBadRequest(fmt.Sprintf("invalid env name %q: %s", env.Name, strings.Join(msgs, ", ")))
+		}
+		if names[env.Name] {
+			return errors.NewBadRequest(fmt.Sprintf("env %s is set twice", env.Name))
+		}
+		names[env.Name] = true
+
+		sources := 0
+		// values masked by GetFunction may be sent back as is
+		if len(env.Value) > 0 && !(env.SecretKeyRef != nil && env.Value == maskedValue) {
+			sources++
+		}
+		if env.SecretKeyRef != nil {
+			sources++
+			if err := checkSecretKey(namespace, env.SecretKeyRef.Name, env.SecretKeyRef.Key); err != nil {
+				return err
+			}
+		}
+		if env.ConfigMapKeyRef != nil {
+			sources++
+			if err := checkConfigMapKey(namespace, env.ConfigMapKeyRef.Name, env.ConfigMapKeyRef.Key); err != nil {
+				return err
+			}
+		}
+		if sources > 1 {
+			return errors.NewBadRequest(fmt.Sprintf("env %s must have one of value, secretKeyRef or configMapKeyRef", env.Name))
+		}
+	}
+
+	for _, from := range spec.EnvFrom {
+		if len(from.Prefix) > 0 {
+			if msgs := validation.IsEnvVarName(from.Prefix); len(msgs) > 0 {
+				return errors.NewBadRequest(fmt.Sprintf("invalid envFrom prefix %q: %s", from.Prefix, strings.Join(msgs, ", ")))
+			}
+		}
+		switch {
+		case len(from.SecretRef) > 0 && len(from.ConfigMapRef) > 0, len(from.SecretRef) == 0 && len(from.ConfigMapRef) == 0:
+			return errors.NewBadRequest("envFrom must have one of secretRef or configMapRef")
+		case len(from.SecretRef) > 0:
+			if err := checkSecretKey(namespace, from.SecretRef, ""); err != nil {
+				return err
+			}
+		default:
+			if err := checkConfigMapKey(namespace, from.ConfigMapRef, ""); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkResources checks the quantities of a container against a plan
+func checkResources(resources *model.Resources, p *plan.Plan) error {
+	if resources == nil {
+		return nil
+	}
+	requests, err := toResourceList(resources.Requests)
+	if err != nil {
+		return err
+	}
+	limits, err := toResourceList(resources.Limits)
+	if err != nil {
+		return err
+	}
+	return p.CheckResources(requests, limits)
+}
+
+// mergeResources returns the resources of a container changed by the
+// quantities set in resources, so that a PATCH keeps the others
+func mergeResources(current corev1.ResourceRequirements, resources *model.Resources) *model.Resources {
+	merged := &model.Resources{
+		Requests: fromResourceList(current.Requests),
+		Limits:   fromResourceList(current.Limits),
+	}
+	mergeResourceList(&merged.Requests, resources.Requests)
+	mergeResourceList(&merged.Limits, resources.Limits)
+	return merged
+}
+
+func mergeResourceList(list *model.ResourceList, change model.ResourceList) {
+	if len(change.CPU) > 0 {
+		list.CPU = change.CPU
+	}
+	if len(change.Memory) > 0 {
+		list.Memory = change.Memory
+	}
+}
+
+// checkSecretKey makes sure a Secret exists, and has key if it is not empty
+func checkSecretKey(namespace, name, key string) error {
+	s, err := cfg.KubeClientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return errors.NewBadRequest(fmt.Sprintf("secret %s not found", name))
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := s.Data[key]; len(key) > 0 && !ok {
+		return errors.NewBadRequest(fmt.Sprintf("secret %s has no key %s", name, key))
+	}
+	return nil
+}
+
+// checkConfigMapKey makes sure a ConfigMap exists, and has key if it is not empty
+func checkConfigMapKey(namespace, name, key string) error {
+	cm, err := cfg.KubeClientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return errors.NewBadRequest(fmt.Sprintf("configmap %s not found", name))
+	}
+	if err != nil {
+		return err
+	}
+	if len(key) == 0 {
+		return nil
+	}
+	_, ok := cm.Data[key]
+	if _, binary := cm.BinaryData[key]; !ok && !binary {
+		return errors.NewBadRequest(fmt.Sprintf("configmap %s has no key %s", name, key))
+	}
+	return nil
+}
+
+// applyContainerSpec sets the fields of spec that are present on a revision
+// template, which Knative then validates
+func applyContainerSpec(t *serving_api.RevisionTemplateSpec, spec model.ContainerSpec) error {
+	rs := &t.Spec
+	container := &rs.Container
+	if spec.Env != nil {
+		container.Env = nil
+		for _, env := range spec.Env {
+			e := corev1.EnvVar{Name: env.Name, Value: env.Value}
+			if ref := env.SecretKeyRef; ref != nil {
+				e.Value = ""
+				e.ValueFrom = &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: ref.Name},
+						Key:                  ref.Key,
+					},
+				}
+			}
+			if ref := env.ConfigMapKeyRef; ref != nil {
+				e.ValueFrom = &corev1.EnvVarSource{
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: ref.Name},
+						Key:                  ref.Key,
+					},
+				}
+			}
+			container.Env = append(container.Env, e)
+		}
+	}
+	if spec.EnvFrom != nil {
+		container.EnvFrom = nil
+		for _, from := range spec.EnvFrom {
+			f := corev1.EnvFromSource{Prefix: from.Prefix}
+			if len(from.SecretRef) > 0 {
+				f.SecretRef = &corev1.SecretEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: from.SecretRef},
+				}
+			} else {
+				f.ConfigMapRef = &corev1.ConfigMapEnvSource{
+					LocalObjectReference: corev1.LocalObjectReference{Name: from.ConfigMapRef},
+				}
+			}
+			container.EnvFrom = append(container.EnvFrom, f)
+		}
+	}
+	if spec.Resources != nil {
+		// quantities were checked by validateContainerSpec
+		container.Resources.Requests, _ = toResourceList(spec.Resources.Requests)
+		container.Resources.Limits, _ = toResourceList(spec.Resources.Limits)
+	}
+	if spec.ContainerConcurrency != nil {
+		rs.ContainerConcurrency = serving_api.RevisionContainerConcurrencyType(*spec.ContainerConcurrency)
+	}
+	if spec.TimeoutSeconds != nil {
+		rs.TimeoutSeconds = *spec.TimeoutSeconds
+	}
+	if spec.Port != nil || len(spec.Protocol) > 0 {
+		port := corev1.ContainerPort{}
+		if len(container.Ports) > 0 {
+			port = container.Ports[0]
+		}
+		if spec.Port != nil {
+			port.ContainerPort = *spec.Port
+		}
+		if len(spec.Protocol) > 0 {
+			port.Name = spec.Protocol
+		}
+		container.Ports = []corev1.ContainerPort{port}
+	}
+	if spec.Command != nil {
+		container.Command = spec.Command
+	}
+	if spec.Args != nil {
+		container.Args = spec.Args
+	}
+	if spec.Autoscaling != nil {
+		if err := applyAutoscaling(t, spec.Autoscaling); err != nil {
+			return err
+		}
+	}
+	if fe := rs.Validate(); fe != nil {
+		return errors.NewBadRequest(fe.Error())
+	}
+	return nil
+}
+
+// toResourceList parses the cpu and memory quantities of a container
+func toResourceList(list model.ResourceList) (corev1.ResourceList, error) {
+	var (
+		rl corev1.ResourceList
+	)
+	for name, value := range map[corev1.ResourceName]string{
+		corev1.ResourceCPU:    list.CPU,
+		corev1.ResourceMemory: list.Memory,
+	} {
+		if len(value) == 0 {
+			continue
+		}
+		q, err := resource.ParseQuantity(value)
+		if err != nil {
+			return rl, errors.NewBadRequest(fmt.Sprintf("invalid %s quantity %q", name, value))
+		}
+		if rl == nil {
+			rl = corev1.ResourceList{}
+		}
+		rl[name] = q
+	}
+	return rl, nil
+}
+
+// fromResourceList formats the cpu and memory quantities of a container
+func fromResourceList(rl corev1.ResourceList) model.ResourceList {
+	var (
+		list model.ResourceList
+	)
+	if q, ok := rl[corev1.ResourceCPU]; ok {
+		list.CPU = q.String()
+	}
+	if q, ok := rl[corev1.ResourceMemory]; ok {
+		list.Memory = q.String()
+	}
+	return list
+}
+
+// containerSpecOf returns the user settable part of a revision template,
+// values that come from Secrets are masked
+func containerSpecOf(t *serving_api.RevisionTemplateSpec) model.ContainerSpec {
+	var (
+		spec      model.ContainerSpec
+		rs        = &t.Spec
+		container = &rs.Container
+	)
+	for _, e := range container.Env {
+		env := model.EnvVar{Name: e.Name, Value: e.Value}
+		if e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil {
+			env.SecretKeyRef = &model.KeyRef{Name: e.ValueFrom.SecretKeyRef.Name, Key: e.ValueFrom.SecretKeyRef.Key}
+			env.Value = maskedValue
+		}
+		if e.ValueFrom != nil && e.ValueFrom.ConfigMapKeyRef != nil {
+			env.ConfigMapKeyRef = &model.KeyRef{Name: e.ValueFrom.ConfigMapKeyRef.Name, Key: e.ValueFrom.ConfigMapKeyRef.Key}
+		}
+		spec.Env = append(spec.Env, env)
+	}
+	for _, f := range container.EnvFrom {
+		from := model.EnvFromSource{Prefix: f.Prefix}
+		if f.SecretRef != nil {
+			from.SecretRef = f.SecretRef.Name
+		}
+		if f.ConfigMapRef != nil {
+			from.ConfigMapRef = f.ConfigMapRef.Name
+		}
+		spec.EnvFrom = append(spec.EnvFrom, from)
+	}
+	if len(container.Resources.Requests) > 0 || len(container.Resources.Limits) > 0 {
+		spec.Resources = &model.Resources{
+			Requests: fromResourceList(container.Resources.Requests),
+			Limits:   fromResourceList(container.Resources.Limits),
+		}
+	}
+	if rs.ContainerConcurrency != 0 {
+		cc := int64(rs.ContainerConcurrency)
+		spec.ContainerConcurrency = &cc
+	}
+	if rs.TimeoutSeconds != 0 {
+		timeout := rs.TimeoutSeconds
+		spec.TimeoutSeconds = &timeout
+	}
+	if len(container.Ports) > 0 {
+		port := container.Ports[0].ContainerPort
+		spec.Port = &port
+		spec.Protocol = container.Ports[0].Name
+	}
+	spec.Command = container.Command
+	spec.Args = container.Args
+	spec.Autoscaling = autoscalingOf(t)
+	return spec
+}
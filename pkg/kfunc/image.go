@@ -0,0 +1,119 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// imageTagLength is how much of a commit sha or checksum goes in a tag
+	imageTagLength = 12
+)
+
+var (
+	commitSha = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// defaultRegistry returns the registry images built from source are pushed
+// to when the caller does not name one. An in-cluster registry Service is
+// addressed by its cluster IP, since nodes pull without cluster DNS. There
+// is no fallback to a public registry, whose accounts do not match user
+// namespaces.
+func defaultRegistry() (string, error) {
+	if len(cfg.RegistryService) > 0 {
+		parts := strings.SplitN(cfg.RegistryService, "/", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("registry service %q is not namespace/name", cfg.RegistryService)
+		}
+		svc, err := cfg.KubeClientset.CoreV1().Services(parts[0]).Get(parts[1], metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if len(svc.Spec.Ports) == 0 || len(svc.Spec.ClusterIP) == 0 || svc.Spec.ClusterIP == "None" {
+			return "", fmt.Errorf("registry service %s has no cluster IP or port", cfg.RegistryService)
+		}
+		return fmt.Sprintf("%s:%d", svc.Spec.ClusterIP, svc.Spec.Ports[0].Port), nil
+	}
+	if len(cfg.ContainerRegistry) > 0 {
+		return cfg.ContainerRegistry, nil
+	}
+	return "", errors.NewBadRequest("image is missing and the server has no default registry")
+}
+
+// imageRepository returns the repository of the images generated for a function
+func imageRepository(namespace, funcName string) (string, error) {
+	registry, err := defaultRegistry()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(registry, "/"), namespace, funcName), nil
+}
+
+// imageName returns <registry>/<namespace>/<function>:<tag> for a function
+// built from source. The tag is the git commit sha or archive checksum, or a
+// timestamp for branches, so that every build pushes a new tag.
+func imageName(namespace, funcName string, source model.SourceRef) (string, error) {
+	repository, err := imageRepository(namespace, funcName)
+	if err != nil {
+		return "", err
+	}
+	tag := time.Now().UTC().Format("20060102-150405")
+	switch {
+	case len(source.SourceArchive) >= imageTagLength:
+		tag = source.SourceArchive[:imageTagLength]
+	case commitSha.MatchString(source.RepoRevision):
+		tag = source.RepoRevision
+		if len(tag) > imageTagLength {
+			tag = tag[:imageTagLength]
+		}
+	}
+	image := repository + ":" + tag
+	return image, validateImage(image)
+}
+
+// isGeneratedImage returns true if image is in the generated repository of a function
+func isGeneratedImage(namespace, funcName, image string) bool {
+	ref, err := name.ParseReference(image, name.WeakValidation)
+	if err != nil {
+		return false
+	}
+	repository, err := imageRepository(namespace, funcName)
+	if err != nil {
+		return false
+	}
+	generated, err := name.NewRepository(repository, name.WeakValidation)
+	if err != nil {
+		return false
+	}
+	return ref.Context().String() == generated.String()
+}
+
+// validateImage checks that image is a valid image reference
+func validateImage(image string) error {
+	if _, err := name.ParseReference(image, name.WeakValidation); err != nil {
+		return errors.NewBadRequest(fmt.Sprintf("invalid image %q: %v", image, err))
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"regexp"
+	"testing"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// withRegistry sets the default registry for the duration of a test
+func withRegistry(t *testing.T, registry string) {
+	containerRegistry, registryService := cfg.ContainerRegistry, cfg.RegistryService
+	cfg.ContainerRegistry, cfg.RegistryService = registry, ""
+	t.Cleanup(func() {
+		cfg.ContainerRegistry, cfg.RegistryService = containerRegistry, registryService
+	})
+}
+
+func TestImageName(t *testing.T) {
+	const checksum = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	tests := []struct {
+		name     string
+		registry string
+		source   model.SourceRef
+		want     string
+		// wantTag matches timestamp tags
+		wantTag string
+		wantErr bool
+	}{
+		{
+			name:     "archive checksum",
+			registry: "registry.example.com",
+			source:   model.SourceRef{SourceArchive: checksum},
+			want:     "registry.example.com/ns/f:0123456789ab",
+		},
+		{
+			name:     "full commit sha",
+			registry: "registry.example.com",
+			source:   model.SourceRef{GitRepo: "https://github.com/a/b", RepoRevision: "a94a8fe5ccb19ba61c4c0873d391e987982fbbd3"},
+			want:     "registry.example.com/ns/f:a94a8fe5ccb1",
+		},
+		{
+			name:     "short commit sha",
+			registry: "10.0.0.5:5000",
+			source:   model.SourceRef{GitRepo: "https://github.com/a/b", RepoRevision: "a94a8fe"},
+			want:     "10.0.0.5:5000/ns/f:a94a8fe",
+		},
+		{
+			name:     "branch",
+			registry: "registry.example.com/",
+			source:   model.SourceRef{GitRepo: "https://github.com/a/b", RepoRevision: "master"},
+			wantTag:  `^registry\.example\.com/ns/f:\d{8}-\d{6}$`,
+		},
+		{
+			name:    "no registry",
+			source:  model.SourceRef{SourceArchive: checksum},
+			wantErr: true,
+		},
+		{
+			name:     "invalid registry",
+			registry: "Not A Registry",
+			source:   model.SourceRef{SourceArchive: checksum},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRegistry(t, tt.registry)
+			got, err := imageName("ns", "f", tt.source)
+			if tt.wantErr {
+				if !errors.IsBadRequest(err) {
+					t.Fatalf("got %q and error %v, want a bad request", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(tt.wantTag) > 0 {
+				if !regexp.MustCompile(tt.wantTag).MatchString(got) {
+					t.Errorf("got %q, want a match of %s", got, tt.wantTag)
+				}
+				return
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsGeneratedImage(t *testing.T) {
+	tests := []struct {
+		name     string
+		registry string
+		image    string
+		want     bool
+	}{
+		{name: "generated", registry: "registry.example.com", image: "registry.example.com/ns/f:0123456789ab", want: true},
+		{name: "other tag", registry: "registry.example.com", image: "registry.example.com/ns/f:latest", want: true},
+		{name: "digest", registry: "registry.example.com", image: "registry.example.com/ns/f@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", want: true},
+		{name: "normalized docker hub name", registry: "docker.io", image: "ns/f:1", want: true},
+		{name: "other function", registry: "registry.example.com", image: "registry.example.com/ns/g:1"},
+		{name: "other registry", registry: "registry.example.com", image: "quay.io/ns/f:1"},
+		{name: "no registry", image: "registry.example.com/ns/f:1"},
+		{name: "invalid image", registry: "registry.example.com", image: "registry.example.com/ns/F:1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withRegistry(t, tt.registry)
+			if got := isGeneratedImage("ns", "f", tt.image); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -14,42 +14,73 @@
 package kfunc
 
 import (
-	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 
 	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kube"
 	"github.com/kubefy/kubefy-server/pkg/model"
 	"github.com/kubefy/kubefy-server/pkg/util"
 
 	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	"github.com/knative/serving/pkg/apis/serving"
 	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 const (
-	defaultContainerRegistry = "docker.io"
-	defaultIstioNamespace    = "istio-system"
-	defaultIstioGatewaySvc   = "istio-ingressgateway"
-	defaultBuildTemplate     = "buildah"
-	defaultNumNodeAddr       = 3
+	defaultIstioNamespace   = "istio-system"
+	defaultIstioGatewaySvc  = "istio-ingressgateway"
+	defaultServingNamespace = "knative-serving"
+	defaultBuildNamespace   = "knative-build"
+	defaultBuildTemplate    = "buildah"
+	defaultNumNodeAddr      = 3
 )
 
-// DeploySrc2Svc deploys a git repo to a Knative Service
-func DeploySrc2Svc(namespace, gitUrl, gitRevision, imageUrl, funcName string) error {
-	if len(gitUrl) == 0 || len(funcName) == 0 || len(imageUrl) == 0 {
-		return fmt.Errorf("git repo, imageUrl, or function name is missing")
-	}
+// SystemNamespaces returns the Istio and Knative namespaces that route and
+// build functions
+func SystemNamespaces() []string {
+	return []string{defaultIstioNamespace, defaultServingNamespace, defaultBuildNamespace}
+}
 
-	if len(gitRevision) == 0 {
-		gitRevision = "master"
+// DeploySrc2Svc deploys a git repo or an uploaded source archive to a
+// Knative Service. Without imageUrl the image is named after the function
+// in the default registry.
+func DeploySrc2Svc(namespace string, source model.SourceRef, imageUrl, funcName string, template model.BuildTemplateRef, spec model.ContainerSpec) error {
+	if len(funcName) == 0 {
+		return errors.NewBadRequest("function name is missing")
+	}
+	if err := validateContainerSpec(namespace, spec); err != nil {
+		return err
+	}
+	src, err := buildSource(namespace, source)
+	if err != nil {
+		return err
+	}
+	if src == nil {
+		return errors.NewBadRequest("git repo or source archive is missing")
+	}
+	if len(imageUrl) == 0 {
+		if imageUrl, err = imageName(namespace, funcName, source); err != nil {
+			return err
+		}
+	} else if err = validateImage(imageUrl); err != nil {
+		return err
+	}
+	instance, err := resolveTemplate(namespace, template, imageUrl)
+	if err != nil {
+		return err
 	}
-	buildTemplate := defaultBuildTemplate
-	if len(cfg.BuildTemplate) != 0 {
-		buildTemplate = cfg.BuildTemplate
+
+	serviceAccount, err := serviceAccountFor(namespace)
+	if err != nil {
+		return err
 	}
 
 	svc := &serving_api.Service{
@@ -60,33 +91,10 @@ func DeploySrc2Svc(namespace, gitUrl, gitRevision, imageUrl, funcName string) er
 		Spec: serving_api.ServiceSpec{
 			RunLatest: &serving_api.RunLatestType{
 				Configuration: serving_api.ConfigurationSpec{
-					Build: &serving_api.RawExtension{
-						Object: &build_api.Build{
-							TypeMeta: metav1.TypeMeta{
-								APIVersion: build_api.SchemeGroupVersion.String(),
-								Kind:       "Build",
-							},
-							Spec: build_api.BuildSpec{
-								Source: &build_api.SourceSpec{
-									Git: &build_api.GitSourceSpec{
-										Url:      gitUrl,
-										Revision: gitRevision,
-									},
-								},
-								Template: &build_api.TemplateInstantiationSpec{
-									Name: buildTemplate,
-									Arguments: []build_api.ArgumentSpec{
-										build_api.ArgumentSpec{
-											Name:  "IMAGE",
-											Value: imageUrl,
-										},
-									},
-								},
-							},
-						},
-					},
+					Build: newBuild(serviceAccount, src, instance),
 					RevisionTemplate: serving_api.RevisionTemplateSpec{
 						Spec: serving_api.RevisionSpec{
+							ServiceAccountName: serviceAccount,
 							Container: corev1.Container{
 								Image: imageUrl,
 							},
@@ -97,15 +105,28 @@ func DeploySrc2Svc(namespace, gitUrl, gitRevision, imageUrl, funcName string) er
 		},
 	}
 
-	_, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Create(svc)
+	if err = applyContainerSpec(&svc.Spec.RunLatest.Configuration.RevisionTemplate, spec); err != nil {
+		return err
+	}
+	_, err = cfg.ServingClientset.ServingV1alpha1().Services(namespace).Create(svc)
 
 	return err
 }
 
 // DeployImg2Svc deploys a container image to a Knative Service
-func DeployImg2Svc(namespace, imageUrl, funcName string) error {
+func DeployImg2Svc(namespace, imageUrl, funcName string, spec model.ContainerSpec) error {
 	if len(imageUrl) == 0 || len(funcName) == 0 {
-		return fmt.Errorf("container image or function name is missing")
+		return errors.NewBadRequest("container image or function name is missing")
+	}
+	if err := validateImage(imageUrl); err != nil {
+		return err
+	}
+	if err := validateContainerSpec(namespace, spec); err != nil {
+		return err
+	}
+	serviceAccount, err := serviceAccountFor(namespace)
+	if err != nil {
+		return err
 	}
 
 	svc := &serving_api.Service{
@@ -118,6 +139,7 @@ func DeployImg2Svc(namespace, imageUrl, funcName string) error {
 				Configuration: serving_api.ConfigurationSpec{
 					RevisionTemplate: serving_api.RevisionTemplateSpec{
 						Spec: serving_api.RevisionSpec{
+							ServiceAccountName: serviceAccount,
 							Container: corev1.Container{
 								Image: imageUrl,
 							},
@@ -128,11 +150,44 @@ func DeployImg2Svc(namespace, imageUrl, funcName string) error {
 		},
 	}
 
-	_, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Create(svc)
+	if err = applyContainerSpec(&svc.Spec.RunLatest.Configuration.RevisionTemplate, spec); err != nil {
+		return err
+	}
+	_, err = cfg.ServingClientset.ServingV1alpha1().Services(namespace).Create(svc)
 
 	return err
 }
 
+// newBuild returns the Build of a Configuration that builds a source with a template
+func newBuild(serviceAccount string, source *build_api.SourceSpec, template *build_api.TemplateInstantiationSpec) *serving_api.RawExtension {
+	return &serving_api.RawExtension{
+		Object: &build_api.Build{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: build_api.SchemeGroupVersion.String(),
+				Kind:       "Build",
+			},
+			Spec: build_api.BuildSpec{
+				ServiceAccountName: serviceAccount,
+				Source:             source,
+				Template:           template,
+			},
+		},
+	}
+}
+
+// serviceAccountFor returns the user service account that carries registry
+// credentials, or an empty name for users created before it existed
+func serviceAccountFor(namespace string) (string, error) {
+	_, err := cfg.KubeClientset.CoreV1().ServiceAccounts(namespace).Get(kube.ServiceAccountName, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return kube.ServiceAccountName, nil
+}
+
 func View(namespace, funcName string) ([]model.Endpoint, string, error) {
 	var (
 		endpoints []model.Endpoint
@@ -141,7 +196,7 @@ func View(namespace, funcName string) ([]model.Endpoint, string, error) {
 	)
 
 	if len(funcName) == 0 {
-		return endpoints, authoriy, fmt.Errorf("function name is missing")
+		return endpoints, authoriy, errors.NewBadRequest("function name is missing")
 	}
 
 	// get istio ingress service
@@ -191,3 +246,140 @@ func View(namespace, funcName string) ([]model.Endpoint, string, error) {
 	authoriy = servingSvc.Status.Domain
 	return endpoints, authoriy, nil
 }
+
+// List returns the names of the Knative Services in a namespace
+func List(namespace string) ([]string, error) {
+	var (
+		names []string
+	)
+	svcs, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return names, err
+	}
+	for _, svc := range svcs.Items {
+		names = append(names, svc.Name)
+	}
+	return names, nil
+}
+
+// Revisions returns the Revisions of a Knative Service, newest configuration generation first
+func Revisions(namespace, funcName string) ([]model.Revision, error) {
+	var (
+		revisions []model.Revision
+	)
+	if len(funcName) == 0 {
+		return revisions, errors.NewBadRequest("function name is missing")
+	}
+	client := cfg.ServingClientset.ServingV1alpha1()
+	if _, err := client.Services(namespace).Get(funcName, metav1.GetOptions{}); err != nil {
+		return revisions, err
+	}
+	listOpts := metav1.ListOptions{LabelSelector: serving.ServiceLabelKey + "=" + funcName}
+	revs, err := client.Revisions(namespace).List(listOpts)
+	if err != nil {
+		return revisions, err
+	}
+	for i := range revs.Items {
+		rev := &revs.Items[i]
+		r := model.Revision{
+			Name:      rev.Name,
+			Image:     rev.Spec.Container.Image,
+			CreatedAt: rev.CreationTimestamp.UTC().Format(time.RFC3339),
+			Ready:     rev.Status.IsReady(),
+		}
+		r.Generation, _ = strconv.ParseInt(rev.Labels[serving.ConfigurationGenerationLabelKey], 10, 64)
+		if ref := rev.BuildRef(); ref != nil {
+			r.Build = ref.Name
+		}
+		revisions = append(revisions, r)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Generation > revisions[j].Generation
+	})
+	return revisions, nil
+}
+
+// Resources returns the Configurations, Revisions and Builds created for a Knative Service
+func Resources(namespace, funcName string) (model.FunctionResources, error) {
+	var (
+		resources model.FunctionResources
+	)
+
+	if len(funcName) == 0 {
+		return resources, errors.NewBadRequest("function name is missing")
+	}
+
+	client := cfg.ServingClientset.ServingV1alpha1()
+	// make sure the function exists so callers can tell NotFound apart
+	if _, err := client.Services(namespace).Get(funcName, metav1.GetOptions{}); err != nil {
+		return resources, err
+	}
+	resources.Service = funcName
+
+	listOpts := metav1.ListOptions{LabelSelector: serving.ServiceLabelKey + "=" + funcName}
+	configs, err := client.Configurations(namespace).List(listOpts)
+	if err != nil {
+		return resources, err
+	}
+	for _, c := range configs.Items {
+		resources.Configurations = append(resources.Configurations, c.Name)
+	}
+	revs, err := client.Revisions(namespace).List(listOpts)
+	if err != nil {
+		return resources, err
+	}
+	for _, rev := range revs.Items {
+		resources.Revisions = append(resources.Revisions, rev.Name)
+		if ref := rev.BuildRef(); ref != nil && ref.Kind == "Build" {
+			resources.Builds = append(resources.Builds, ref.Name)
+		}
+	}
+	return resources, nil
+}
+
+// Delete deletes a Knative Service and the Configurations, Revisions and Builds it created
+func Delete(namespace, funcName string) (model.FunctionResources, error) {
+	var (
+		removed model.FunctionResources
+	)
+
+	// collect the children before the service goes away
+	resources, err := Resources(namespace, funcName)
+	if err != nil {
+		return removed, err
+	}
+
+	client := cfg.ServingClientset.ServingV1alpha1()
+	propagation := metav1.DeletePropagationBackground
+	deleteOpts := &metav1.DeleteOptions{PropagationPolicy: &propagation}
+	if err = client.Services(namespace).Delete(funcName, deleteOpts); err != nil && !errors.IsNotFound(err) {
+		return removed, err
+	}
+	removed.Service = funcName
+	glog.Infof("deleted service %s/%s", namespace, funcName)
+
+	// owner references normally garbage collect these, delete them explicitly
+	// so nothing is left behind if the service was not their owner
+	for _, c := range resources.Configurations {
+		if err = client.Configurations(namespace).Delete(c, deleteOpts); err != nil && !errors.IsNotFound(err) {
+			return removed, err
+		}
+		removed.Configurations = append(removed.Configurations, c)
+	}
+	for _, rev := range resources.Revisions {
+		if err = client.Revisions(namespace).Delete(rev, deleteOpts); err != nil && !errors.IsNotFound(err) {
+			return removed, err
+		}
+		removed.Revisions = append(removed.Revisions, rev)
+	}
+	for _, b := range resources.Builds {
+		err = cfg.BuildClient.Delete().Namespace(namespace).Resource("builds").Name(b).Body(deleteOpts).Do().Error()
+		if err != nil && !errors.IsNotFound(err) {
+			return removed, err
+		}
+		removed.Builds = append(removed.Builds, b)
+	}
+	glog.Infof("deleted function %s/%s: %+v", namespace, funcName, removed)
+
+	return removed, nil
+}
@@ -0,0 +1,112 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"time"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	duckv1alpha1 "github.com/knative/pkg/apis/duck/v1alpha1"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ListFunctions returns a page of the Knative Services in a namespace that
+// match labelSelector, and the token of the next page
+func ListFunctions(namespace, labelSelector string, limit int64, continueToken string) ([]model.Function, string, error) {
+	var (
+		functions []model.Function
+	)
+	listOpts := metav1.ListOptions{
+		LabelSelector: labelSelector,
+		Limit:         limit,
+		Continue:      continueToken,
+	}
+	svcs, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).List(listOpts)
+	if err != nil {
+		return functions, "", err
+	}
+	for i := range svcs.Items {
+		functions = append(functions, functionOf(&svcs.Items[i]))
+	}
+	return functions, svcs.Continue, nil
+}
+
+// functionOf summarizes the spec and status of a Knative Service
+func functionOf(svc *serving_api.Service) model.Function {
+	f := model.Function{
+		Name:                  svc.Name,
+		Namespace:             svc.Namespace,
+		Domain:                svc.Status.Domain,
+		Ready:                 svc.Status.IsReady(),
+		LatestCreatedRevision: svc.Status.LatestCreatedRevisionName,
+		LatestReadyRevision:   svc.Status.LatestReadyRevisionName,
+	}
+	f.Conditions = conditionsOf(svc.Status.Conditions)
+	config := configurationOf(svc)
+	if config == nil {
+		return f
+	}
+	f.Image = config.RevisionTemplate.Spec.Container.Image
+	if config.Build != nil {
+		var b build_api.Build
+		if err := config.Build.AsDuck(&b); err == nil && b.Spec.Source != nil {
+			if git := b.Spec.Source.Git; git != nil {
+				f.Source = &model.GitSource{
+					Url:      git.Url,
+					Revision: git.Revision,
+				}
+			}
+			f.SourceArchive = archiveOf(b.Spec.Source)
+		}
+	}
+	return f
+}
+
+// conditionsOf converts the conditions of a Knative resource
+func conditionsOf(conditions duckv1alpha1.Conditions) []model.Condition {
+	var (
+		conds []model.Condition
+	)
+	for _, c := range conditions {
+		cond := model.Condition{
+			Type:    string(c.Type),
+			Status:  string(c.Status),
+			Reason:  c.Reason,
+			Message: c.Message,
+		}
+		if !c.LastTransitionTime.Inner.IsZero() {
+			cond.LastTransitionTime = c.LastTransitionTime.Inner.UTC().Format(time.RFC3339)
+		}
+		conds = append(conds, cond)
+	}
+	return conds
+}
+
+// configurationOf returns the Configuration of a Knative Service whatever
+// its mode, or nil for manual Services
+func configurationOf(svc *serving_api.Service) *serving_api.ConfigurationSpec {
+	switch {
+	case svc.Spec.RunLatest != nil:
+		return &svc.Spec.RunLatest.Configuration
+	case svc.Spec.Release != nil:
+		return &svc.Spec.Release.Configuration
+	case svc.Spec.DeprecatedPinned != nil:
+		return &svc.Spec.DeprecatedPinned.Configuration
+	}
+	return nil
+}
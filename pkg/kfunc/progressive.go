@@ -0,0 +1,351 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"github.com/knative/serving/pkg/apis/serving"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// the state of a progressive rollout lives on the Service so that it
+// survives server restarts, the label only selects the Services to reconcile
+const (
+	progressiveLabel      = "kubefy.io/progressive"
+	stepsAnnotation       = "kubefy.io/rollout-steps"
+	intervalAnnotation    = "kubefy.io/rollout-interval"
+	probeAnnotation       = "kubefy.io/rollout-probe"
+	maxRestartsAnnotation = "kubefy.io/rollout-max-restarts"
+	stateAnnotation       = "kubefy.io/rollout-state"
+	messageAnnotation     = "kubefy.io/rollout-message"
+	stepTimeAnnotation    = "kubefy.io/rollout-step-time"
+
+	defaultRolloutInterval = 5 * time.Minute
+	probeTimeout           = 10 * time.Second
+)
+
+var (
+	defaultRolloutSteps = []int{5, 25, 50, 100}
+)
+
+// StartProgressive moves a Knative Service into Release mode and lets the
+// rollout reconciler step the candidate traffic up while it stays healthy
+func StartProgressive(namespace, funcName string, req model.ProgressiveRolloutRequest) (model.Rollout, error) {
+	steps := req.Steps
+	if len(steps) == 0 {
+		steps = defaultRolloutSteps
+	}
+	for i, step := range steps {
+		if step < 1 || step > 100 || (i > 0 && step <= steps[i-1]) {
+			return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("steps must increase from 1 to 100")
+		}
+	}
+	if steps[len(steps)-1] != 100 {
+		steps = append(steps, 100)
+	}
+	if steps[0] == 100 {
+		return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("first step must be below 100")
+	}
+	interval := defaultRolloutInterval
+	if len(req.Interval) > 0 {
+		d, err := time.ParseDuration(req.Interval)
+		if err != nil || d < 0 {
+			return model.Rollout{FunctionName: funcName}, errors.NewBadRequest(fmt.Sprintf("invalid interval %q", req.Interval))
+		}
+		interval = d
+	}
+	if len(req.ProbePath) > 0 && !strings.HasPrefix(req.ProbePath, "/") {
+		return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("probe path must start with /")
+	}
+	if req.MaxRestarts < 0 {
+		return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("max restarts must not be negative")
+	}
+	candidate := req.Candidate
+	if len(candidate) == 0 {
+		candidate = serving_api.ReleaseLatestRevisionKeyword
+	}
+	if candidate != serving_api.ReleaseLatestRevisionKeyword {
+		if err := checkRevision(namespace, funcName, candidate); err != nil {
+			return model.Rollout{FunctionName: funcName}, err
+		}
+	}
+
+	return updateRelease(namespace, funcName, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		// pin @latest, otherwise the reconciler would check the current
+		// revision against itself when there is no newer one
+		revision := candidate
+		if revision == serving_api.ReleaseLatestRevisionKeyword {
+			revision = svc.Status.LatestCreatedRevisionName
+			if len(revision) == 0 {
+				return errors.NewBadRequest("function has no revision to roll out")
+			}
+		}
+		if revision == release.Revisions[0] {
+			return errors.NewBadRequest("candidate is already the current revision")
+		}
+		release.Revisions = []string{release.Revisions[0], revision}
+		release.RolloutPercent = steps[0]
+
+		var s []string
+		for _, step := range steps {
+			s = append(s, strconv.Itoa(step))
+		}
+		if svc.Labels == nil {
+			svc.Labels = map[string]string{}
+		}
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Labels[progressiveLabel] = "true"
+		svc.Annotations[stepsAnnotation] = strings.Join(s, ",")
+		svc.Annotations[intervalAnnotation] = interval.String()
+		svc.Annotations[probeAnnotation] = req.ProbePath
+		svc.Annotations[maxRestartsAnnotation] = strconv.Itoa(req.MaxRestarts)
+		svc.Annotations[stateAnnotation] = model.RolloutProgressing
+		svc.Annotations[stepTimeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+		delete(svc.Annotations, messageAnnotation)
+		return nil
+	})
+}
+
+// ReconcileRollouts steps the progressive rollouts every period until stopCh is closed
+func ReconcileRollouts(period time.Duration, stopCh <-chan struct{}) {
+	glog.Infof("reconciling progressive rollouts every %v", period)
+	wait.Until(func() {
+		listOpts := metav1.ListOptions{LabelSelector: progressiveLabel + "=true"}
+		svcs, err := cfg.ServingClientset.ServingV1alpha1().Services(metav1.NamespaceAll).List(listOpts)
+		if err != nil {
+			glog.Warningf("failed to list progressive rollouts: %v", err)
+			return
+		}
+		for i := range svcs.Items {
+			if err := reconcileRollout(&svcs.Items[i]); err != nil {
+				glog.Warningf("failed to reconcile rollout of %s/%s: %v", svcs.Items[i].Namespace, svcs.Items[i].Name, err)
+			}
+		}
+	}, period, stopCh)
+}
+
+// reconcileRollout checks the candidate of a progressive rollout, rolls it
+// back if it is unhealthy and moves it to the next step once the interval passed
+func reconcileRollout(svc *serving_api.Service) error {
+	progress := progressOf(svc)
+	release := svc.Spec.Release
+	if progress == nil || progress.State != model.RolloutProgressing || release == nil || len(release.Revisions) < 2 {
+		// the rollout was changed behind our back, stop tracking it
+		_, err := updateService(svc.Namespace, svc.Name, func(svc *serving_api.Service) error {
+			delete(svc.Labels, progressiveLabel)
+			return nil
+		})
+		return err
+	}
+	interval, stepTime, err := parseProgress(svc)
+	if err != nil {
+		// never step on made up values, a zero interval would jump to 100%
+		message := err.Error()
+		glog.Warningf("failing rollout of %s/%s: %s", svc.Namespace, svc.Name, message)
+		_, err = updateRelease(svc.Namespace, svc.Name, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+			release.Revisions = release.Revisions[:1]
+			release.RolloutPercent = 0
+			finishProgress(svc, model.RolloutFailed, message)
+			return nil
+		})
+		return err
+	}
+	candidate := release.Revisions[1]
+	if candidate == serving_api.ReleaseLatestRevisionKeyword {
+		candidate = svc.Status.LatestCreatedRevisionName
+	}
+	if len(candidate) == 0 {
+		return nil
+	}
+
+	ready, failure, err := checkCandidate(svc.Namespace, candidate, svc.Status.Domain, progress)
+	if err != nil {
+		return err
+	}
+	if len(failure) > 0 {
+		glog.Warningf("rolling back %s/%s: %s", svc.Namespace, svc.Name, failure)
+		_, err = updateRelease(svc.Namespace, svc.Name, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+			release.Revisions = release.Revisions[:1]
+			release.RolloutPercent = 0
+			finishProgress(svc, model.RolloutRolledBack, failure)
+			return nil
+		})
+		return err
+	}
+	if !ready {
+		return nil
+	}
+	if time.Since(stepTime) < interval {
+		return nil
+	}
+
+	next := 100
+	for _, step := range progress.Steps {
+		if step > release.RolloutPercent {
+			next = step
+			break
+		}
+	}
+	_, err = updateRelease(svc.Namespace, svc.Name, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		if len(release.Revisions) < 2 || svc.Labels[progressiveLabel] != "true" {
+			return nil
+		}
+		if next < 100 {
+			release.RolloutPercent = next
+			svc.Annotations[stepTimeAnnotation] = time.Now().UTC().Format(time.RFC3339)
+			return nil
+		}
+		release.Revisions = []string{candidate}
+		release.RolloutPercent = 0
+		finishProgress(svc, model.RolloutSucceeded, "")
+		return nil
+	})
+	if err == nil {
+		glog.Infof("rollout of %s/%s at %d%%", svc.Namespace, svc.Name, next)
+	}
+	return err
+}
+
+// checkCandidate returns whether the candidate revision is ready, and why
+// it failed if it is unhealthy
+func checkCandidate(namespace, revName, domain string, progress *model.Progress) (bool, string, error) {
+	rev, err := cfg.ServingClientset.ServingV1alpha1().Revisions(namespace).Get(revName, metav1.GetOptions{})
+	if err != nil {
+		return false, "", err
+	}
+	if c := rev.Status.GetCondition(serving_api.RevisionConditionReady); c != nil && c.IsFalse() {
+		return false, fmt.Sprintf("revision %s is not ready: %s", revName, c.Message), nil
+	}
+	if !rev.Status.IsReady() {
+		return false, "", nil
+	}
+
+	listOpts := metav1.ListOptions{LabelSelector: serving.RevisionLabelKey + "=" + revName}
+	pods, err := cfg.KubeClientset.CoreV1().Pods(namespace).List(listOpts)
+	if err != nil {
+		return false, "", err
+	}
+	restarts := 0
+	for _, pod := range pods.Items {
+		for _, cs := range pod.Status.ContainerStatuses {
+			restarts += int(cs.RestartCount)
+		}
+	}
+	if restarts > progress.MaxRestarts {
+		return false, fmt.Sprintf("revision %s restarted %d times", revName, restarts), nil
+	}
+
+	if len(progress.ProbePath) > 0 && len(domain) > 0 {
+		url := "http://" + defaultIstioGatewaySvc + "." + defaultIstioNamespace + ".svc" + progress.ProbePath
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			return false, "", err
+		}
+		req.Host = candidateTrafficName + "." + domain
+		client := &http.Client{Timeout: probeTimeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, fmt.Sprintf("probe of %s failed: %v", req.Host, err), nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			return false, fmt.Sprintf("probe of %s returned %s", req.Host, resp.Status), nil
+		}
+	}
+	return true, "", nil
+}
+
+// progressOf returns the progressive rollout state of a Knative Service
+func progressOf(svc *serving_api.Service) *model.Progress {
+	state, ok := svc.Annotations[stateAnnotation]
+	if !ok {
+		return nil
+	}
+	progress := &model.Progress{
+		Interval:     svc.Annotations[intervalAnnotation],
+		ProbePath:    svc.Annotations[probeAnnotation],
+		State:        state,
+		Message:      svc.Annotations[messageAnnotation],
+		LastStepTime: svc.Annotations[stepTimeAnnotation],
+	}
+	progress.MaxRestarts, _ = strconv.Atoi(svc.Annotations[maxRestartsAnnotation])
+	for _, s := range strings.Split(svc.Annotations[stepsAnnotation], ",") {
+		if step, err := strconv.Atoi(s); err == nil {
+			progress.Steps = append(progress.Steps, step)
+		}
+	}
+	return progress
+}
+
+// parseProgress checks the progressive rollout annotations of a Knative
+// Service, which can be edited by hand, and returns its interval and the
+// time of the last step
+func parseProgress(svc *serving_api.Service) (time.Duration, time.Time, error) {
+	var (
+		stepTime time.Time
+	)
+	interval, err := time.ParseDuration(svc.Annotations[intervalAnnotation])
+	if err != nil || interval < 0 {
+		return 0, stepTime, fmt.Errorf("invalid %s annotation %q", intervalAnnotation, svc.Annotations[intervalAnnotation])
+	}
+	if stepTime, err = time.Parse(time.RFC3339, svc.Annotations[stepTimeAnnotation]); err != nil {
+		return 0, stepTime, fmt.Errorf("invalid %s annotation %q", stepTimeAnnotation, svc.Annotations[stepTimeAnnotation])
+	}
+	if restarts, err := strconv.Atoi(svc.Annotations[maxRestartsAnnotation]); err != nil || restarts < 0 {
+		return 0, stepTime, fmt.Errorf("invalid %s annotation %q", maxRestartsAnnotation, svc.Annotations[maxRestartsAnnotation])
+	}
+	steps := strings.Split(svc.Annotations[stepsAnnotation], ",")
+	last := 0
+	for _, s := range steps {
+		step, err := strconv.Atoi(s)
+		if err != nil || step <= last || step > 100 {
+			return 0, stepTime, fmt.Errorf("invalid %s annotation %q", stepsAnnotation, svc.Annotations[stepsAnnotation])
+		}
+		last = step
+	}
+	return interval, stepTime, nil
+}
+
+// finishProgress stops reconciling a progressive rollout and records its outcome
+func finishProgress(svc *serving_api.Service, state, message string) {
+	delete(svc.Labels, progressiveLabel)
+	if svc.Annotations == nil {
+		svc.Annotations = map[string]string{}
+	}
+	svc.Annotations[stateAnnotation] = state
+	svc.Annotations[messageAnnotation] = message
+}
+
+// clearProgress drops the progressive rollout state of a Knative Service
+func clearProgress(svc *serving_api.Service) {
+	delete(svc.Labels, progressiveLabel)
+	for _, a := range []string{stepsAnnotation, intervalAnnotation, probeAnnotation, maxRestartsAnnotation, stateAnnotation, messageAnnotation, stepTimeAnnotation} {
+		delete(svc.Annotations, a)
+	}
+}
@@ -0,0 +1,266 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"github.com/knative/serving/pkg/apis/serving"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	currentTrafficName   = "current"
+	candidateTrafficName = "candidate"
+)
+
+// GetRollout returns the release state and traffic split of a Knative Service
+func GetRollout(namespace, funcName string) (model.Rollout, error) {
+	if len(funcName) == 0 {
+		return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("function name is missing")
+	}
+	svc, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Get(funcName, metav1.GetOptions{})
+	if err != nil {
+		return model.Rollout{FunctionName: funcName}, err
+	}
+	return rolloutOf(svc), nil
+}
+
+// SetRollout moves a Knative Service into Release mode and sends percent of
+// the traffic to the candidate revision
+func SetRollout(namespace, funcName, candidate string, percent int) (model.Rollout, error) {
+	if len(candidate) == 0 {
+		candidate = serving_api.ReleaseLatestRevisionKeyword
+	}
+	if candidate != serving_api.ReleaseLatestRevisionKeyword {
+		if err := checkRevision(namespace, funcName, candidate); err != nil {
+			return model.Rollout{FunctionName: funcName}, err
+		}
+	}
+	return updateRelease(namespace, funcName, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		if candidate == release.Revisions[0] {
+			return errors.NewBadRequest("candidate is already the current revision")
+		}
+		release.Revisions = []string{release.Revisions[0], candidate}
+		release.RolloutPercent = percent
+		// a manual split takes over from a progressive rollout
+		clearProgress(svc)
+		return nil
+	})
+}
+
+// Promote makes the candidate revision the current one and sends all the traffic to it
+func Promote(namespace, funcName string) (model.Rollout, error) {
+	return updateRelease(namespace, funcName, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		if len(release.Revisions) < 2 {
+			return errors.NewBadRequest("function has no candidate revision")
+		}
+		candidate := release.Revisions[1]
+		if candidate == serving_api.ReleaseLatestRevisionKeyword {
+			// pin the revision that was tested rather than whatever comes next
+			candidate = svc.Status.LatestReadyRevisionName
+		}
+		release.Revisions = []string{candidate}
+		release.RolloutPercent = 0
+		clearProgress(svc)
+		return nil
+	})
+}
+
+// Abort drops the candidate revision and sends all the traffic back to the current one
+func Abort(namespace, funcName string) (model.Rollout, error) {
+	return updateRelease(namespace, funcName, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		if len(release.Revisions) < 2 {
+			return errors.NewBadRequest("function has no candidate revision")
+		}
+		release.Revisions = release.Revisions[:1]
+		release.RolloutPercent = 0
+		clearProgress(svc)
+		return nil
+	})
+}
+
+// Rollback pins all the traffic of a Knative Service to an older revision.
+// New revisions get no traffic until RunLatest is called.
+func Rollback(namespace, funcName, revName string) (model.Rollout, error) {
+	if len(revName) == 0 {
+		return model.Rollout{FunctionName: funcName}, errors.NewBadRequest("revision is missing")
+	}
+	if err := checkRevision(namespace, funcName, revName); err != nil {
+		return model.Rollout{FunctionName: funcName}, err
+	}
+	return updateRelease(namespace, funcName, func(svc *serving_api.Service, release *serving_api.ReleaseType) error {
+		release.Revisions = []string{revName}
+		release.RolloutPercent = 0
+		clearProgress(svc)
+		return nil
+	})
+}
+
+// RunLatest moves a Knative Service back to RunLatest mode, so that its
+// latest ready revision gets all the traffic
+func RunLatest(namespace, funcName string) (model.Rollout, error) {
+	svc, err := updateService(namespace, funcName, func(svc *serving_api.Service) error {
+		if svc.Spec.RunLatest != nil {
+			return nil
+		}
+		config := configurationOf(svc)
+		if config == nil {
+			return errors.NewBadRequest("function is managed manually")
+		}
+		svc.Spec = serving_api.ServiceSpec{
+			RunLatest: &serving_api.RunLatestType{Configuration: *config},
+		}
+		clearProgress(svc)
+		return nil
+	})
+	if err != nil {
+		return model.Rollout{FunctionName: funcName}, err
+	}
+	glog.Infof("function %s/%s runs latest", namespace, funcName)
+	return rolloutOf(svc), nil
+}
+
+// updateRelease applies change to the Release of a Knative Service, moving
+// it into Release mode first, and retries on conflicts
+func updateRelease(namespace, funcName string, change func(*serving_api.Service, *serving_api.ReleaseType) error) (model.Rollout, error) {
+	svc, err := updateService(namespace, funcName, func(svc *serving_api.Service) error {
+		release, err := toRelease(svc)
+		if err != nil {
+			return err
+		}
+		if err = change(svc, release); err != nil {
+			return err
+		}
+		if fe := release.Validate(); fe != nil {
+			return errors.NewBadRequest(fe.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		return model.Rollout{FunctionName: funcName}, err
+	}
+	rollout := rolloutOf(svc)
+	glog.Infof("function %s/%s rollout %+v", namespace, funcName, rollout)
+	return rollout, nil
+}
+
+// updateService applies change to a Knative Service and retries on conflicts
+func updateService(namespace, funcName string, change func(*serving_api.Service) error) (*serving_api.Service, error) {
+	var (
+		updated *serving_api.Service
+	)
+	if len(funcName) == 0 {
+		return nil, errors.NewBadRequest("function name is missing")
+	}
+	client := cfg.ServingClientset.ServingV1alpha1().Services(namespace)
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		svc, err := client.Get(funcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if err = change(svc); err != nil {
+			return err
+		}
+		updated, err = client.Update(svc)
+		return err
+	})
+	return updated, err
+}
+
+// toRelease switches a Knative Service to Release mode, keeping its
+// Configuration and serving its latest ready revision as the current one
+func toRelease(svc *serving_api.Service) (*serving_api.ReleaseType, error) {
+	if svc.Spec.Release != nil {
+		return svc.Spec.Release, nil
+	}
+	var (
+		current string
+		config  *serving_api.ConfigurationSpec
+	)
+	switch {
+	case svc.Spec.RunLatest != nil:
+		current = svc.Status.LatestReadyRevisionName
+		config = &svc.Spec.RunLatest.Configuration
+	case svc.Spec.DeprecatedPinned != nil:
+		current = svc.Spec.DeprecatedPinned.RevisionName
+		config = &svc.Spec.DeprecatedPinned.Configuration
+	default:
+		return nil, errors.NewBadRequest("function is managed manually")
+	}
+	if len(current) == 0 {
+		return nil, errors.NewConflict(serving_api.Resource("services"), svc.Name, fmt.Errorf("function has no ready revision"))
+	}
+	svc.Spec = serving_api.ServiceSpec{
+		Release: &serving_api.ReleaseType{
+			Revisions:     []string{current},
+			Configuration: *config,
+		},
+	}
+	return svc.Spec.Release, nil
+}
+
+// checkRevision makes sure a revision belongs to the Knative Service
+func checkRevision(namespace, funcName, revName string) error {
+	rev, err := cfg.ServingClientset.ServingV1alpha1().Revisions(namespace).Get(revName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if rev.Labels[serving.ServiceLabelKey] != funcName {
+		return errors.NewBadRequest(fmt.Sprintf("revision %s does not belong to function %s", revName, funcName))
+	}
+	return nil
+}
+
+// rolloutOf returns the release state of a Knative Service, with the
+// subroute hosts of its traffic targets
+func rolloutOf(svc *serving_api.Service) model.Rollout {
+	rollout := model.Rollout{FunctionName: svc.Name}
+	if release := svc.Spec.Release; release != nil {
+		if len(release.Revisions) > 0 {
+			rollout.Current = release.Revisions[0]
+		}
+		if len(release.Revisions) > 1 {
+			rollout.Candidate = release.Revisions[1]
+		}
+		rollout.Percent = release.RolloutPercent
+	}
+	for _, t := range svc.Status.Traffic {
+		target := model.TrafficTarget{
+			Name:         t.Name,
+			RevisionName: t.RevisionName,
+			Percent:      t.Percent,
+		}
+		if len(t.Name) > 0 && len(svc.Status.Domain) > 0 {
+			target.Host = t.Name + "." + svc.Status.Domain
+		}
+		switch t.Name {
+		case currentTrafficName:
+			rollout.CurrentHost = target.Host
+		case candidateTrafficName:
+			rollout.CandidateHost = target.Host
+		}
+		rollout.Traffic = append(rollout.Traffic, target)
+	}
+	rollout.Progress = progressOf(svc)
+	return rollout
+}
@@ -0,0 +1,99 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/storage"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	defaultGitRevision = "master"
+	sourceChecksumEnv  = "SOURCE_CHECKSUM"
+	// fetchSourceScript downloads, verifies and unpacks a source archive
+	// into the build workspace
+	fetchSourceScript = `set -e
+wget -q -O /tmp/source "$SOURCE_URL"
+echo "$SOURCE_CHECKSUM  /tmp/source" | sha256sum -c -
+if [ "$SOURCE_FORMAT" = zip ]; then
+  unzip -q -o /tmp/source -d /workspace
+else
+  tar -xzf /tmp/source -C /workspace
+fi`
+)
+
+// buildSource returns the Build source of a function, nil if the function
+// is not built from source
+func buildSource(namespace string, source model.SourceRef) (*build_api.SourceSpec, error) {
+	switch {
+	case len(source.GitRepo) > 0 && len(source.SourceArchive) > 0:
+		return nil, errors.NewBadRequest("repo and sourceArchive cannot both be set")
+	case len(source.SourceArchive) > 0:
+		if len(source.RepoRevision) > 0 {
+			return nil, errors.NewBadRequest("revision only applies to git repos")
+		}
+		return archiveSource(namespace, source.SourceArchive)
+	case len(source.GitRepo) > 0:
+		revision := source.RepoRevision
+		if len(revision) == 0 {
+			revision = defaultGitRevision
+		}
+		return &build_api.SourceSpec{
+			Git: &build_api.GitSourceSpec{
+				Url:      source.GitRepo,
+				Revision: revision,
+			},
+		}, nil
+	}
+	return nil, nil
+}
+
+// archiveSource returns a custom Build source that fetches an uploaded
+// source archive through a presigned url of the user bucket
+func archiveSource(namespace, checksum string) (*build_api.SourceSpec, error) {
+	url, format, err := storage.SourceURL(namespace, checksum)
+	if err != nil {
+		return nil, err
+	}
+	return &build_api.SourceSpec{
+		Custom: &corev1.Container{
+			Image:   cfg.SourceFetchImage,
+			Command: []string{"/bin/sh", "-c", fetchSourceScript},
+			Env: []corev1.EnvVar{
+				{Name: "SOURCE_URL", Value: url},
+				{Name: "SOURCE_FORMAT", Value: format},
+				{Name: sourceChecksumEnv, Value: checksum},
+			},
+		},
+	}, nil
+}
+
+// archiveOf returns the checksum of the source archive a Build fetches, or
+// an empty string for other sources
+func archiveOf(source *build_api.SourceSpec) string {
+	if source == nil || source.Custom == nil {
+		return ""
+	}
+	for _, e := range source.Custom.Env {
+		if e.Name == sourceChecksumEnv {
+			return e.Value
+		}
+	}
+	return ""
+}
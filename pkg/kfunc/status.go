@@ -0,0 +1,213 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"github.com/knative/serving/pkg/apis/serving"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	minRewatchBackoff = 500 * time.Millisecond
+	maxRewatchBackoff = 5 * time.Second
+)
+
+// Status returns the conditions of a Knative Service, its Configuration and
+// Route, and the pods of its latest revision
+func Status(namespace, funcName string) (model.FunctionStatus, error) {
+	if len(funcName) == 0 {
+		return model.FunctionStatus{}, errors.NewBadRequest("function name is missing")
+	}
+	svc, err := cfg.ServingClientset.ServingV1alpha1().Services(namespace).Get(funcName, metav1.GetOptions{})
+	if err != nil {
+		return model.FunctionStatus{}, err
+	}
+	return statusOf(svc)
+}
+
+// WaitReady blocks until a Knative Service is ready or failed, and returns
+// its status. It returns a Timeout error if that takes longer than timeout.
+func WaitReady(namespace, funcName string, timeout time.Duration) (model.FunctionStatus, error) {
+	if len(funcName) == 0 {
+		return model.FunctionStatus{}, errors.NewBadRequest("function name is missing")
+	}
+	client := cfg.ServingClientset.ServingV1alpha1().Services(namespace)
+	svc, err := client.Get(funcName, metav1.GetOptions{})
+	if err != nil {
+		return model.FunctionStatus{}, err
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	backoff := minRewatchBackoff
+	for !isSettled(svc) {
+		listOpts := metav1.ListOptions{
+			FieldSelector:   fields.OneTermEqualSelector("metadata.name", funcName).String(),
+			ResourceVersion: svc.ResourceVersion,
+		}
+		w, err := client.Watch(listOpts)
+		if err != nil {
+			return model.FunctionStatus{}, err
+		}
+		var expired bool
+		svc, expired, err = nextSettled(w, svc, deadline.C)
+		w.Stop()
+		if err != nil {
+			status, _ := statusOf(svc)
+			return status, err
+		}
+		if isSettled(svc) {
+			break
+		}
+
+		// do not hammer the API server with watches that end right away
+		select {
+		case <-deadline.C:
+			status, _ := statusOf(svc)
+			return status, errors.NewTimeoutError("function is not ready yet", 0)
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRewatchBackoff {
+			backoff = maxRewatchBackoff
+		}
+		if expired {
+			// the resource version is too old to watch from, start over
+			if svc, err = client.Get(funcName, metav1.GetOptions{}); err != nil {
+				return model.FunctionStatus{}, err
+			}
+		}
+	}
+	return statusOf(svc)
+}
+
+// nextSettled reads the events of a watch until the Service is settled, the
+// watch ends or the deadline passes. expired is set if the watch failed, in
+// which case its resource version should not be watched from again.
+func nextSettled(w watch.Interface, svc *serving_api.Service, deadline <-chan time.Time) (*serving_api.Service, bool, error) {
+	for {
+		select {
+		case <-deadline:
+			return svc, false, errors.NewTimeoutError("function is not ready yet", 0)
+		case event, ok := <-w.ResultChan():
+			if !ok {
+				// the server closed the watch, start another one
+				return svc, false, nil
+			}
+			switch event.Type {
+			case watch.Deleted:
+				return svc, false, errors.NewNotFound(serving_api.Resource("services"), svc.Name)
+			case watch.Error:
+				glog.Warningf("watch of %s/%s failed: %v", svc.Namespace, svc.Name, errors.FromObject(event.Object))
+				return svc, true, nil
+			}
+			if s, ok := event.Object.(*serving_api.Service); ok {
+				svc = s
+				if isSettled(svc) {
+					return svc, false, nil
+				}
+			}
+		}
+	}
+}
+
+// isSettled returns true once the latest generation of a Service is ready or failed
+func isSettled(svc *serving_api.Service) bool {
+	if svc.Status.ObservedGeneration < svc.Generation {
+		return false
+	}
+	c := svc.Status.GetCondition(serving_api.ServiceConditionReady)
+	return c != nil && !c.IsUnknown()
+}
+
+// statusOf collects the status of a Knative Service
+func statusOf(svc *serving_api.Service) (model.FunctionStatus, error) {
+	status := model.FunctionStatus{
+		Conditions:     conditionsOf(svc.Status.Conditions),
+		LatestRevision: svc.Status.LatestCreatedRevisionName,
+	}
+	if isSettled(svc) {
+		status.Ready = svc.Status.IsReady()
+		status.Failed = !status.Ready
+	}
+
+	client := cfg.ServingClientset.ServingV1alpha1()
+	// Knative names the Configuration and Route after the Service
+	config, err := client.Configurations(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return status, err
+	} else if err == nil {
+		status.ConfigurationConditions = conditionsOf(config.Status.Conditions)
+	}
+	route, err := client.Routes(svc.Namespace).Get(svc.Name, metav1.GetOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		return status, err
+	} else if err == nil {
+		status.RouteConditions = conditionsOf(route.Status.Conditions)
+	}
+
+	if len(status.LatestRevision) == 0 {
+		return status, nil
+	}
+	listOpts := metav1.ListOptions{LabelSelector: serving.RevisionLabelKey + "=" + status.LatestRevision}
+	pods, err := cfg.KubeClientset.CoreV1().Pods(svc.Namespace).List(listOpts)
+	if err != nil {
+		return status, err
+	}
+	for i := range pods.Items {
+		status.Pods = append(status.Pods, podStatusOf(&pods.Items[i]))
+	}
+	return status, nil
+}
+
+// podStatusOf summarizes a pod, with the reason of its first unhealthy container
+func podStatusOf(pod *corev1.Pod) model.PodStatus {
+	ps := model.PodStatus{
+		Name:  pod.Name,
+		Phase: string(pod.Status.Phase),
+	}
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			ps.Ready = c.Status == corev1.ConditionTrue
+		}
+	}
+	var statuses []corev1.ContainerStatus
+	statuses = append(statuses, pod.Status.InitContainerStatuses...)
+	statuses = append(statuses, pod.Status.ContainerStatuses...)
+	for _, cs := range statuses {
+		ps.Restarts += cs.RestartCount
+		if len(ps.Reason) > 0 {
+			continue
+		}
+		if w := cs.State.Waiting; w != nil {
+			ps.Reason, ps.Message = w.Reason, w.Message
+		} else if t := cs.State.Terminated; t != nil && t.ExitCode != 0 {
+			ps.Reason, ps.Message = t.Reason, t.Message
+		}
+	}
+	if len(ps.Reason) == 0 {
+		ps.Reason, ps.Message = pod.Status.Reason, pod.Status.Message
+	}
+	return ps
+}
@@ -0,0 +1,197 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+const (
+	// imageParameter is the template parameter kfunc sets to the function image
+	imageParameter = "IMAGE"
+)
+
+// ListTemplates returns the BuildTemplates of a namespace and the
+// ClusterBuildTemplates, with their parameters
+func ListTemplates(namespace string) ([]model.BuildTemplate, error) {
+	var (
+		templates []model.BuildTemplate
+	)
+	var bts build_api.BuildTemplateList
+	if err := cfg.BuildClient.Get().Namespace(namespace).Resource("buildtemplates").Do().Into(&bts); err != nil {
+		return templates, err
+	}
+	for _, bt := range bts.Items {
+		templates = append(templates, templateOf(bt.Name, build_api.BuildTemplateKind, bt.Spec))
+	}
+	var cbts build_api.ClusterBuildTemplateList
+	if err := cfg.BuildClient.Get().Resource("clusterbuildtemplates").Do().Into(&cbts); err != nil {
+		return templates, err
+	}
+	for _, cbt := range cbts.Items {
+		templates = append(templates, templateOf(cbt.Name, build_api.ClusterBuildTemplateKind, cbt.Spec))
+	}
+	return templates, nil
+}
+
+// resolveTemplate finds the template of ref and checks the arguments against
+// its parameters, IMAGE is set to imageUrl
+func resolveTemplate(namespace string, ref model.BuildTemplateRef, imageUrl string) (*build_api.TemplateInstantiationSpec, error) {
+	name := ref.BuildTemplate
+	if len(name) == 0 {
+		name = defaultBuildTemplate
+		if len(cfg.BuildTemplate) != 0 {
+			name = cfg.BuildTemplate
+		}
+	}
+	kind := build_api.TemplateKind(ref.BuildTemplateKind)
+	spec, kind, err := getTemplateSpec(namespace, name, kind)
+	if err != nil {
+		return nil, err
+	}
+	return instantiateTemplate(name, kind, spec, ref.BuildArguments, imageUrl)
+}
+
+// instantiateTemplate checks the arguments against the parameters of a
+// template, IMAGE is set to imageUrl. Parameters in the image of a privileged
+// step cannot be set, or any image could run privileged on the node.
+func instantiateTemplate(name string, kind build_api.TemplateKind, spec build_api.BuildTemplateSpec, arguments map[string]string, imageUrl string) (*build_api.TemplateInstantiationSpec, error) {
+	args := map[string]string{}
+	for k, v := range arguments {
+		args[k] = v
+	}
+	args[imageParameter] = imageUrl
+	declared := map[string]bool{}
+	var missing []string
+	for _, p := range spec.Parameters {
+		declared[p.Name] = true
+		if _, ok := args[p.Name]; !ok && p.Default == nil {
+			missing = append(missing, p.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, errors.NewBadRequest(fmt.Sprintf("build template %s needs arguments %s", name, strings.Join(missing, ", ")))
+	}
+	fixed := privilegedImageParameters(spec)
+	instance := &build_api.TemplateInstantiationSpec{Name: name, Kind: kind}
+	for k, v := range args {
+		if !declared[k] {
+			if k == imageParameter {
+				continue
+			}
+			return nil, errors.NewBadRequest(fmt.Sprintf("build template %s has no parameter %s", name, k))
+		}
+		if _, ok := arguments[k]; ok && fixed[k] {
+			return nil, errors.NewBadRequest(fmt.Sprintf("parameter %s of build template %s sets the image of a privileged step and cannot be passed", k, name))
+		}
+		instance.Arguments = append(instance.Arguments, build_api.ArgumentSpec{Name: k, Value: v})
+	}
+	if !declared[imageParameter] {
+		return nil, errors.NewBadRequest(fmt.Sprintf("build template %s has no %s parameter", name, imageParameter))
+	}
+	sort.Slice(instance.Arguments, func(i, j int) bool {
+		return instance.Arguments[i].Name < instance.Arguments[j].Name
+	})
+	return instance, nil
+}
+
+// privilegedImageParameters returns the parameters used in the images of the
+// privileged steps of a template
+func privilegedImageParameters(spec build_api.BuildTemplateSpec) map[string]bool {
+	params := map[string]bool{}
+	for _, step := range spec.Steps {
+		if sc := step.SecurityContext; sc == nil || sc.Privileged == nil || !*sc.Privileged {
+			continue
+		}
+		for _, ref := range templateParamRef.FindAllStringSubmatch(step.Image, -1) {
+			params[ref[1]] = true
+		}
+	}
+	return params
+}
+
+// mergeTemplateRef returns the template of an update. Staying on the current
+// template keeps its arguments, the new ones win.
+func mergeTemplateRef(current *build_api.TemplateInstantiationSpec, template model.BuildTemplateRef) model.BuildTemplateRef {
+	ref := template
+	if current == nil || (len(ref.BuildTemplate) > 0 && ref.BuildTemplate != current.Name) {
+		return ref
+	}
+	ref.BuildTemplate = current.Name
+	if len(ref.BuildTemplateKind) == 0 {
+		ref.BuildTemplateKind = string(current.Kind)
+	}
+	ref.BuildArguments = map[string]string{}
+	for _, arg := range current.Arguments {
+		ref.BuildArguments[arg.Name] = arg.Value
+	}
+	for k, v := range template.BuildArguments {
+		ref.BuildArguments[k] = v
+	}
+	return ref
+}
+
+// getTemplateSpec returns the spec and kind of a build template, looking up
+// the namespace first when kind is empty
+func getTemplateSpec(namespace, name string, kind build_api.TemplateKind) (build_api.BuildTemplateSpec, build_api.TemplateKind, error) {
+	switch kind {
+	case build_api.BuildTemplateKind, "":
+		var bt build_api.BuildTemplate
+		err := cfg.BuildClient.Get().Namespace(namespace).Resource("buildtemplates").Name(name).Do().Into(&bt)
+		if err == nil {
+			return bt.Spec, build_api.BuildTemplateKind, nil
+		}
+		if !errors.IsNotFound(err) || kind == build_api.BuildTemplateKind {
+			return build_api.BuildTemplateSpec{}, kind, templateError(name, err)
+		}
+		fallthrough
+	case build_api.ClusterBuildTemplateKind:
+		var cbt build_api.ClusterBuildTemplate
+		err := cfg.BuildClient.Get().Resource("clusterbuildtemplates").Name(name).Do().Into(&cbt)
+		if err != nil {
+			return build_api.BuildTemplateSpec{}, kind, templateError(name, err)
+		}
+		return cbt.Spec, build_api.ClusterBuildTemplateKind, nil
+	}
+	return build_api.BuildTemplateSpec{}, kind, errors.NewBadRequest(fmt.Sprintf("invalid build template kind %q", kind))
+}
+
+// templateError turns a missing template into a bad request
+func templateError(name string, err error) error {
+	if errors.IsNotFound(err) {
+		return errors.NewBadRequest(fmt.Sprintf("build template %s not found", name))
+	}
+	return err
+}
+
+func templateOf(name string, kind build_api.TemplateKind, spec build_api.BuildTemplateSpec) model.BuildTemplate {
+	t := model.BuildTemplate{Name: name, Kind: string(kind)}
+	for _, p := range spec.Parameters {
+		t.Parameters = append(t.Parameters, model.TemplateParameter{
+			Name:        p.Name,
+			Description: p.Description,
+			Default:     p.Default,
+			Required:    p.Default == nil,
+		})
+	}
+	return t
+}
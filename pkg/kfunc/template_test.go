@@ -0,0 +1,293 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+)
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestInstantiateTemplate(t *testing.T) {
+	spec := build_api.BuildTemplateSpec{
+		Parameters: []build_api.ParameterSpec{
+			{Name: imageParameter},
+			{Name: "DOCKERFILE", Default: strPtr("./Dockerfile")},
+			{Name: "CONTEXT"},
+		},
+	}
+	noImage := build_api.BuildTemplateSpec{
+		Parameters: []build_api.ParameterSpec{{Name: "CONTEXT", Default: strPtr(".")}},
+	}
+	privileged := true
+	privilegedStep := build_api.BuildTemplateSpec{
+		Parameters: []build_api.ParameterSpec{
+			{Name: imageParameter},
+			{Name: "BUILDER_IMAGE", Default: strPtr("quay.io/buildah/stable:v1.7")},
+			{Name: "DOCKERFILE", Default: strPtr("./Dockerfile")},
+		},
+		Steps: []corev1.Container{
+			{Name: "build", Image: "${BUILDER_IMAGE}", SecurityContext: &corev1.SecurityContext{Privileged: &privileged}},
+		},
+	}
+	tests := []struct {
+		name    string
+		spec    build_api.BuildTemplateSpec
+		args    map[string]string
+		want    []build_api.ArgumentSpec
+		wantErr bool
+	}{
+		{
+			name: "required argument and image",
+			spec: spec,
+			args: map[string]string{"CONTEXT": "/src"},
+			want: []build_api.ArgumentSpec{{Name: "CONTEXT", Value: "/src"}, {Name: imageParameter, Value: "registry/ns/f:1"}},
+		},
+		{
+			name: "defaults can be overridden",
+			spec: spec,
+			args: map[string]string{"CONTEXT": "/src", "DOCKERFILE": "build/Dockerfile"},
+			want: []build_api.ArgumentSpec{{Name: "CONTEXT", Value: "/src"}, {Name: "DOCKERFILE", Value: "build/Dockerfile"}, {Name: imageParameter, Value: "registry/ns/f:1"}},
+		},
+		{
+			name: "image argument is overridden",
+			spec: spec,
+			args: map[string]string{"CONTEXT": "/src", imageParameter: "other/image"},
+			want: []build_api.ArgumentSpec{{Name: "CONTEXT", Value: "/src"}, {Name: imageParameter, Value: "registry/ns/f:1"}},
+		},
+		{
+			name:    "missing required argument",
+			spec:    spec,
+			wantErr: true,
+		},
+		{
+			name:    "undeclared argument",
+			spec:    spec,
+			args:    map[string]string{"CONTEXT": "/src", "BUILD_ARG": "x"},
+			wantErr: true,
+		},
+		{
+			name:    "template without image parameter",
+			spec:    noImage,
+			wantErr: true,
+		},
+		{
+			name: "privileged step image keeps its default",
+			spec: privilegedStep,
+			args: map[string]string{"DOCKERFILE": "build/Dockerfile"},
+			want: []build_api.ArgumentSpec{{Name: "DOCKERFILE", Value: "build/Dockerfile"}, {Name: imageParameter, Value: "registry/ns/f:1"}},
+		},
+		{
+			name:    "privileged step image cannot be passed",
+			spec:    privilegedStep,
+			args:    map[string]string{"BUILDER_IMAGE": "attacker/image"},
+			wantErr: true,
+		},
+		{
+			name:    "catalog buildah image cannot be passed",
+			spec:    catalogSpec(t, "buildah"),
+			args:    map[string]string{"BUILDER_IMAGE": "attacker/image"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := instantiateTemplate("buildah", build_api.ClusterBuildTemplateKind, tt.spec, tt.args, "registry/ns/f:1")
+			if tt.wantErr {
+				if !errors.IsBadRequest(err) {
+					t.Fatalf("got error %v, want a bad request", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Name != "buildah" || got.Kind != build_api.ClusterBuildTemplateKind {
+				t.Errorf("got template %s %s", got.Kind, got.Name)
+			}
+			if !reflect.DeepEqual(got.Arguments, tt.want) {
+				t.Errorf("got arguments %v, want %v", got.Arguments, tt.want)
+			}
+		})
+	}
+}
+
+// catalogSpec returns the spec of a catalog template
+func catalogSpec(t *testing.T, name string) build_api.BuildTemplateSpec {
+	for _, template := range catalog() {
+		if template.Name == name {
+			return template.Spec
+		}
+	}
+	t.Fatalf("no catalog template %s", name)
+	return build_api.BuildTemplateSpec{}
+}
+
+func TestCatalogPrivilegedImages(t *testing.T) {
+	for _, template := range catalog() {
+		if params := privilegedImageParameters(template.Spec); len(params) > 0 {
+			t.Errorf("privileged steps of %s take their image from parameters %v", template.Name, params)
+		}
+	}
+}
+
+func TestMergeTemplateRef(t *testing.T) {
+	current := &build_api.TemplateInstantiationSpec{
+		Name: "kaniko",
+		Kind: build_api.ClusterBuildTemplateKind,
+		Arguments: []build_api.ArgumentSpec{
+			{Name: imageParameter, Value: "registry/ns/f:1"},
+			{Name: "DOCKERFILE", Value: "Dockerfile.prod"},
+		},
+	}
+	tests := []struct {
+		name     string
+		current  *build_api.TemplateInstantiationSpec
+		template model.BuildTemplateRef
+		want     model.BuildTemplateRef
+	}{
+		{
+			name:     "no current template",
+			template: model.BuildTemplateRef{BuildArguments: map[string]string{"CONTEXT": "."}},
+			want:     model.BuildTemplateRef{BuildArguments: map[string]string{"CONTEXT": "."}},
+		},
+		{
+			name:    "current template keeps its arguments",
+			current: current,
+			want: model.BuildTemplateRef{
+				BuildTemplate:     "kaniko",
+				BuildTemplateKind: string(build_api.ClusterBuildTemplateKind),
+				BuildArguments:    map[string]string{imageParameter: "registry/ns/f:1", "DOCKERFILE": "Dockerfile.prod"},
+			},
+		},
+		{
+			name:     "new arguments win",
+			current:  current,
+			template: model.BuildTemplateRef{BuildTemplate: "kaniko", BuildArguments: map[string]string{"DOCKERFILE": "Dockerfile", "CONTEXT": "src"}},
+			want: model.BuildTemplateRef{
+				BuildTemplate:     "kaniko",
+				BuildTemplateKind: string(build_api.ClusterBuildTemplateKind),
+				BuildArguments:    map[string]string{imageParameter: "registry/ns/f:1", "DOCKERFILE": "Dockerfile", "CONTEXT": "src"},
+			},
+		},
+		{
+			name:     "kind is kept unless set",
+			current:  current,
+			template: model.BuildTemplateRef{BuildTemplateKind: string(build_api.BuildTemplateKind)},
+			want: model.BuildTemplateRef{
+				BuildTemplate:     "kaniko",
+				BuildTemplateKind: string(build_api.BuildTemplateKind),
+				BuildArguments:    map[string]string{imageParameter: "registry/ns/f:1", "DOCKERFILE": "Dockerfile.prod"},
+			},
+		},
+		{
+			name:     "another template drops the arguments",
+			current:  current,
+			template: model.BuildTemplateRef{BuildTemplate: "buildah"},
+			want:     model.BuildTemplateRef{BuildTemplate: "buildah"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mergeTemplateRef(tt.current, tt.template); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetTemplateSpec(t *testing.T) {
+	const prefix = "/apis/build.knative.dev/v1alpha1/"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var obj interface{}
+		status := http.StatusOK
+		switch strings.TrimPrefix(r.URL.Path, prefix) {
+		case "namespaces/ns/buildtemplates/local":
+			obj = &build_api.BuildTemplate{Spec: build_api.BuildTemplateSpec{Parameters: []build_api.ParameterSpec{{Name: "LOCAL"}}}}
+		case "clusterbuildtemplates/local", "clusterbuildtemplates/shared":
+			obj = &build_api.ClusterBuildTemplate{Spec: build_api.BuildTemplateSpec{Parameters: []build_api.ParameterSpec{{Name: "SHARED"}}}}
+		case "namespaces/ns/buildtemplates/broken":
+			status = http.StatusInternalServerError
+			obj = &metav1.Status{Status: metav1.StatusFailure, Code: int32(status), Reason: metav1.StatusReasonInternalError}
+		default:
+			status = http.StatusNotFound
+			obj = &metav1.Status{Status: metav1.StatusFailure, Code: int32(status), Reason: metav1.StatusReasonNotFound}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(obj)
+	}))
+	defer server.Close()
+
+	client, err := cfg.NewBuildClient(&rest.Config{Host: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buildClient := cfg.BuildClient
+	cfg.BuildClient = client
+	defer func() { cfg.BuildClient = buildClient }()
+
+	tests := []struct {
+		name      string
+		template  string
+		kind      build_api.TemplateKind
+		wantKind  build_api.TemplateKind
+		wantParam string
+		wantErr   func(error) bool
+	}{
+		{name: "namespace template wins", template: "local", wantKind: build_api.BuildTemplateKind, wantParam: "LOCAL"},
+		{name: "falls through to the cluster", template: "shared", wantKind: build_api.ClusterBuildTemplateKind, wantParam: "SHARED"},
+		{name: "cluster kind skips the namespace", template: "local", kind: build_api.ClusterBuildTemplateKind, wantKind: build_api.ClusterBuildTemplateKind, wantParam: "SHARED"},
+		{name: "namespace kind does not fall through", template: "shared", kind: build_api.BuildTemplateKind, wantErr: errors.IsBadRequest},
+		{name: "missing everywhere", template: "missing", wantErr: errors.IsBadRequest},
+		{name: "server errors do not fall through", template: "broken", wantErr: errors.IsInternalError},
+		{name: "invalid kind", template: "local", kind: "Template", wantErr: errors.IsBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, kind, err := getTemplateSpec("ns", tt.template, tt.kind)
+			if tt.wantErr != nil {
+				if !tt.wantErr(err) {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if kind != tt.wantKind {
+				t.Errorf("got kind %s, want %s", kind, tt.wantKind)
+			}
+			if len(spec.Parameters) != 1 || spec.Parameters[0].Name != tt.wantParam {
+				t.Errorf("got parameters %v, want %s", spec.Parameters, tt.wantParam)
+			}
+		})
+	}
+}
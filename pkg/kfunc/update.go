@@ -0,0 +1,238 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kfunc
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/plan"
+
+	build_api "github.com/knative/build/pkg/apis/build/v1alpha1"
+	serving_api "github.com/knative/serving/pkg/apis/serving/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	// revisionTimeout bounds the wait for Knative to create the Revision of an update
+	revisionTimeout = 30 * time.Second
+)
+
+// Update changes the image, source, build template or container of an
+// existing Knative Service, so that Knative creates a new Revision. Empty
+// arguments keep their current value unless replace is set, in which case a
+// Service without a source stops being built and the container is reset to
+// spec.
+func Update(namespace, funcName string, source model.SourceRef, imageUrl string, template model.BuildTemplateRef, spec model.ContainerSpec, replace bool) (model.UpdateFunctionResponse, error) {
+	var (
+		rep        model.UpdateFunctionResponse
+		generation int64
+	)
+	rep.FunctionName = funcName
+	if len(funcName) == 0 {
+		return rep, errors.NewBadRequest("function name is missing")
+	}
+	if len(imageUrl) > 0 {
+		if err := validateImage(imageUrl); err != nil {
+			return rep, err
+		}
+	}
+	if err := validateContainerSpec(namespace, spec); err != nil {
+		return rep, err
+	}
+	serviceAccount, err := serviceAccountFor(namespace)
+	if err != nil {
+		return rep, err
+	}
+
+	client := cfg.ServingClientset.ServingV1alpha1().Services(namespace)
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		svc, err := client.Get(funcName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		config := configurationOf(svc)
+		if config == nil {
+			return errors.NewBadRequest("function is managed manually")
+		}
+		if err = updateConfiguration(namespace, funcName, config, serviceAccount, source, imageUrl, template, spec, replace); err != nil {
+			return err
+		}
+		generation = svc.Generation
+		rep.PreviousRevision = svc.Status.LatestCreatedRevisionName
+		updated, err := client.Update(svc)
+		if err != nil {
+			return err
+		}
+		rep.Generation = updated.Generation
+		return nil
+	})
+	if err != nil {
+		return rep, err
+	}
+	// an update that does not change the spec does not create a Revision
+	if rep.Generation == generation {
+		rep.Revision = rep.PreviousRevision
+		return rep, nil
+	}
+
+	err = wait.PollImmediate(time.Second, revisionTimeout, func() (bool, error) {
+		svc, err := client.Get(funcName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if svc.Status.ObservedGeneration < rep.Generation || svc.Status.LatestCreatedRevisionName == rep.PreviousRevision {
+			return false, nil
+		}
+		rep.Revision = svc.Status.LatestCreatedRevisionName
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		glog.Warningf("no revision of %s/%s generation %d yet", namespace, funcName, rep.Generation)
+		return rep, nil
+	}
+	glog.Infof("updated function %s/%s to revision %s", namespace, funcName, rep.Revision)
+	return rep, err
+}
+
+// updateConfiguration changes the container and the Build of a Configuration
+func updateConfiguration(namespace, funcName string, config *serving_api.ConfigurationSpec, serviceAccount string, source model.SourceRef, imageUrl string, template model.BuildTemplateRef, spec model.ContainerSpec, replace bool) error {
+	var (
+		err error
+	)
+	container := &config.RevisionTemplate.Spec.Container
+	sourceChanged := !reflect.DeepEqual(source, model.SourceRef{})
+	if replace {
+		if len(imageUrl) == 0 && !sourceChanged {
+			return errors.NewBadRequest("container image is missing")
+		}
+		if len(imageUrl) == 0 {
+			if imageUrl, err = imageName(namespace, funcName, source); err != nil {
+				return err
+			}
+		}
+		*container = corev1.Container{Image: imageUrl}
+		config.RevisionTemplate.Spec.ContainerConcurrency = 0
+		config.RevisionTemplate.Spec.TimeoutSeconds = 0
+		clearAutoscaling(&config.RevisionTemplate)
+		if err := applyContainerSpec(&config.RevisionTemplate, spec); err != nil {
+			return err
+		}
+		config.Build = nil
+		src, err := buildSource(namespace, source)
+		if err != nil || src == nil {
+			return err
+		}
+		instance, err := resolveTemplate(namespace, template, imageUrl)
+		if err != nil {
+			return err
+		}
+		config.Build = newBuild(serviceAccount, src, instance)
+		return nil
+	}
+
+	templateChanged := !reflect.DeepEqual(template, model.BuildTemplateRef{})
+	if !sourceChanged && len(imageUrl) == 0 && !templateChanged && reflect.DeepEqual(spec, model.ContainerSpec{}) {
+		return errors.NewBadRequest("nothing to update")
+	}
+	// a new source of a function with a generated image gets a new tag, so
+	// that the new Revision does not run a cached image
+	if len(imageUrl) == 0 && sourceChanged && isGeneratedImage(namespace, funcName, container.Image) {
+		if imageUrl, err = imageName(namespace, funcName, source); err != nil {
+			return err
+		}
+	}
+	if len(imageUrl) > 0 {
+		container.Image = imageUrl
+	}
+	if spec.Resources != nil {
+		// requests and limits left out keep their value, the plan applies
+		// to the result
+		spec.Resources = mergeResources(container.Resources, spec.Resources)
+		p, err := plan.ForNamespace(namespace)
+		if err != nil {
+			return err
+		}
+		if err = checkResources(spec.Resources, p); err != nil {
+			return err
+		}
+	}
+	if err := applyContainerSpec(&config.RevisionTemplate, spec); err != nil {
+		return err
+	}
+	if config.Build == nil {
+		if len(source.GitRepo) == 0 && len(source.RepoRevision) > 0 {
+			return errors.NewBadRequest("function is not built from a git repo")
+		}
+		src, err := buildSource(namespace, source)
+		if err != nil || src == nil {
+			return err
+		}
+		instance, err := resolveTemplate(namespace, template, container.Image)
+		if err != nil {
+			return err
+		}
+		config.Build = newBuild(serviceAccount, src, instance)
+		return nil
+	}
+
+	var b build_api.Build
+	if err := config.Build.AsDuck(&b); err != nil {
+		return err
+	}
+	switch {
+	case len(source.GitRepo) > 0 || len(source.SourceArchive) > 0:
+		src, err := buildSource(namespace, source)
+		if err != nil {
+			return err
+		}
+		// keep the git revision when only the repo url changes
+		if current := b.Spec.Source; src.Git != nil && len(source.RepoRevision) == 0 && current != nil && current.Git != nil && len(current.Git.Revision) > 0 {
+			src.Git.Revision = current.Git.Revision
+		}
+		b.Spec.Source = src
+	case len(source.RepoRevision) > 0:
+		if b.Spec.Source == nil || b.Spec.Source.Git == nil {
+			return errors.NewBadRequest("function is not built from a git repo")
+		}
+		b.Spec.Source.Git.Revision = source.RepoRevision
+	default:
+		// presigned archive urls expire, sign again for the next build
+		if checksum := archiveOf(b.Spec.Source); len(checksum) > 0 {
+			src, err := archiveSource(namespace, checksum)
+			if err != nil {
+				return err
+			}
+			b.Spec.Source = src
+		}
+	}
+	if len(imageUrl) > 0 || templateChanged {
+		ref := mergeTemplateRef(b.Spec.Template, template)
+		instance, err := resolveTemplate(namespace, ref, container.Image)
+		if err != nil {
+			return err
+		}
+		b.Spec.Template = instance
+	}
+	config.Build = &serving_api.RawExtension{Object: &b}
+	return nil
+}
@@ -14,6 +14,9 @@
 package kube
 
 import (
+	"encoding/base64"
+	"encoding/json"
+
 	cfg "github.com/kubefy/kubefy-server/pkg/config"
 
 	"k8s.io/api/core/v1"
@@ -21,14 +24,28 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+const (
+	// UserNameLabel is the label that ties kube objects to a kubefy user
+	UserNameLabel = "kubefy.io/username"
+	// ServiceAccountName is the per-user service account used by builds and function pods
+	ServiceAccountName = "kubefy"
+	// buildDockerAnnotation tells Knative Build which registry a secret is for
+	buildDockerAnnotation = "build.knative.dev/docker-0"
+	// buildGitAnnotation tells Knative Build which git host a secret is for
+	buildGitAnnotation = "build.knative.dev/git-0"
+	// sshKnownHostsKey is the optional known_hosts entry of ssh-auth secrets
+	sshKnownHostsKey = "known_hosts"
+)
+
 // CreateNamespace creates a kube namespace
-func CreateNamespace(namespace, label string) error {
+func CreateNamespace(namespace, label string, annotations map[string]string) error {
 	ns := &v1.Namespace{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: namespace,
 			Labels: map[string]string{
-				"kubefy.io/username": label,
+				UserNameLabel: label,
 			},
+			Annotations: annotations,
 		},
 	}
 
@@ -39,23 +56,172 @@ func CreateNamespace(namespace, label string) error {
 	return nil
 }
 
-// CreateSecret creates a kube secret
-func CreateSecret(namespace, label, secretName, key, value string) error {
+// CreateDockerConfigSecret creates or replaces a kubernetes.io/dockerconfigjson
+// secret for registry. The secret is annotated so Knative Build pushes with it.
+func CreateDockerConfigSecret(namespace, label, secretName, registry, username, password string) error {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	config := map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: map[string]string{
+				"username": username,
+				"password": password,
+				"auth":     auth,
+			},
+		},
+	}
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
 	secret := &v1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      secretName,
 			Namespace: namespace,
 			Labels: map[string]string{
-				"kubefy.io/username": label,
+				UserNameLabel: label,
+			},
+			Annotations: map[string]string{
+				buildDockerAnnotation: registry,
 			},
 		},
+		Type: v1.SecretTypeDockerConfigJson,
 		Data: map[string][]byte{
-			key: []byte(value),
+			v1.DockerConfigJsonKey: data,
 		},
 	}
-	_, err := cfg.KubeClientset.CoreV1().Secrets(namespace).Create(secret)
-	if err != nil && !errors.IsAlreadyExists(err) {
+	return applySecret(secret)
+}
+
+// CreateGitBasicAuthSecret creates or replaces a kubernetes.io/basic-auth
+// secret that Knative Build uses to fetch https git sources from host
+func CreateGitBasicAuthSecret(namespace, label, secretName, host, username, password string) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				UserNameLabel: label,
+			},
+			Annotations: map[string]string{
+				buildGitAnnotation: "https://" + host,
+			},
+		},
+		Type: v1.SecretTypeBasicAuth,
+		Data: map[string][]byte{
+			v1.BasicAuthUsernameKey: []byte(username),
+			v1.BasicAuthPasswordKey: []byte(password),
+		},
+	}
+	return applySecret(secret)
+}
+
+// CreateGitSSHSecret creates or replaces a kubernetes.io/ssh-auth secret that
+// Knative Build uses to fetch ssh git sources from host
+func CreateGitSSHSecret(namespace, label, secretName, host, privateKey, knownHosts string) error {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				UserNameLabel: label,
+			},
+			Annotations: map[string]string{
+				buildGitAnnotation: host,
+			},
+		},
+		Type: v1.SecretTypeSSHAuth,
+		Data: map[string][]byte{
+			v1.SSHAuthPrivateKey: []byte(privateKey),
+		},
+	}
+	if len(knownHosts) > 0 {
+		secret.Data[sshKnownHostsKey] = []byte(knownHosts)
+	}
+	return applySecret(secret)
+}
+
+// CreateServiceAccount creates a service account, or adds the secrets to an
+// existing one. Secrets are mounted into builds, pull secrets are used by pods.
+func CreateServiceAccount(namespace, label, saName string, secrets, pullSecrets []string) error {
+	client := cfg.KubeClientset.CoreV1().ServiceAccounts(namespace)
+	sa, err := client.Get(saName, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		sa = &v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      saName,
+				Namespace: namespace,
+				Labels: map[string]string{
+					UserNameLabel: label,
+				},
+			},
+		}
+		addSecretRefs(sa, secrets, pullSecrets)
+		if _, err = client.Create(sa); err != nil && !errors.IsAlreadyExists(err) {
+			return err
+		}
+		return nil
+	}
+	if addSecretRefs(sa, secrets, pullSecrets) {
+		_, err = client.Update(sa)
+	}
+	return err
+}
+
+// addSecretRefs adds missing secret references and returns true if sa changed
+func addSecretRefs(sa *v1.ServiceAccount, secrets, pullSecrets []string) bool {
+	changed := false
+	for _, name := range secrets {
+		found := false
+		for _, ref := range sa.Secrets {
+			if ref.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sa.Secrets = append(sa.Secrets, v1.ObjectReference{Name: name})
+			changed = true
+		}
+	}
+	for _, name := range pullSecrets {
+		found := false
+		for _, ref := range sa.ImagePullSecrets {
+			if ref.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			sa.ImagePullSecrets = append(sa.ImagePullSecrets, v1.LocalObjectReference{Name: name})
+			changed = true
+		}
+	}
+	return changed
+}
+
+// applySecret creates a secret or replaces an existing one. The secret type
+// cannot be updated, so a secret of another type is deleted first.
+func applySecret(secret *v1.Secret) error {
+	client := cfg.KubeClientset.CoreV1().Secrets(secret.Namespace)
+	old, err := client.Get(secret.Name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		_, err = client.Create(secret)
 		return err
 	}
-	return nil
+	if old.Type != secret.Type {
+		if err = client.Delete(secret.Name, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+		_, err = client.Create(secret)
+		return err
+	}
+	secret.ResourceVersion = old.ResourceVersion
+	_, err = client.Update(secret)
+	return err
 }
@@ -0,0 +1,183 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+
+	"k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+const (
+	// kubectlName names the service account, role and binding of user kubeconfigs
+	kubectlName      = "kubefy-kubectl"
+	kubectlTokenName = "kubefy-kubectl-token"
+)
+
+// CreateKubeconfig returns a kubeconfig limited to the user namespace. It
+// creates the service account, role and role binding it authenticates as.
+func CreateKubeconfig(namespace, label string) ([]byte, error) {
+	meta := metav1.ObjectMeta{
+		Name:      kubectlName,
+		Namespace: namespace,
+		Labels: map[string]string{
+			UserNameLabel: label,
+		},
+	}
+	readOnly := []string{"get", "list", "watch"}
+	// RBAC cannot exclude secrets by name for list, so none can be read
+	createOnly := []string{"create"}
+
+	sa := &v1.ServiceAccount{ObjectMeta: meta}
+	if _, err := cfg.KubeClientset.CoreV1().ServiceAccounts(namespace).Create(sa); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	role := &rbacv1.Role{
+		ObjectMeta: meta,
+		// Deliberately narrower than read/write on Knative services, pods/logs
+		// and secrets. Knative services are read-only, they are changed
+		// through kubefy so that plan limits and rollout state stay under its
+		// control. Secrets can only be created, which keeps the kubefy token
+		// and registry credentials out of reach. Nothing else is granted.
+		Rules: []rbacv1.PolicyRule{
+			{
+				APIGroups: []string{"serving.knative.dev"},
+				Resources: []string{"services", "configurations", "revisions", "routes"},
+				Verbs:     readOnly,
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"pods", "pods/log"},
+				Verbs:     readOnly,
+			},
+			{
+				APIGroups: []string{""},
+				Resources: []string{"secrets"},
+				Verbs:     createOnly,
+			},
+		},
+	}
+	roles := cfg.KubeClientset.RbacV1().Roles(namespace)
+	if old, err := roles.Get(kubectlName, metav1.GetOptions{}); err == nil {
+		// keep the rules in line with this server version
+		role.ResourceVersion = old.ResourceVersion
+		if _, err = roles.Update(role); err != nil {
+			return nil, err
+		}
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	} else if _, err = roles.Create(role); err != nil {
+		return nil, err
+	}
+
+	binding := &rbacv1.RoleBinding{
+		ObjectMeta: meta,
+		Subjects: []rbacv1.Subject{
+			{
+				Kind:      rbacv1.ServiceAccountKind,
+				Name:      kubectlName,
+				Namespace: namespace,
+			},
+		},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: rbacv1.GroupName,
+			Kind:     "Role",
+			Name:     kubectlName,
+		},
+	}
+	if _, err := cfg.KubeClientset.RbacV1().RoleBindings(namespace).Create(binding); err != nil && !errors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	token, err := serviceAccountToken(namespace, label)
+	if err != nil {
+		return nil, err
+	}
+
+	server := cfg.KubeAPIServer
+	if len(server) == 0 {
+		server = cfg.RestConfig.Host
+	}
+	caData := cfg.RestConfig.CAData
+	if len(caData) == 0 && len(cfg.RestConfig.CAFile) > 0 {
+		if caData, err = ioutil.ReadFile(cfg.RestConfig.CAFile); err != nil {
+			return nil, err
+		}
+	}
+
+	name := "kubefy-" + label
+	config := clientcmdapi.NewConfig()
+	config.Clusters[name] = &clientcmdapi.Cluster{
+		Server:                   server,
+		CertificateAuthorityData: caData,
+		InsecureSkipTLSVerify:    cfg.RestConfig.Insecure,
+	}
+	config.AuthInfos[name] = &clientcmdapi.AuthInfo{
+		Token: token,
+	}
+	config.Contexts[name] = &clientcmdapi.Context{
+		Cluster:   name,
+		AuthInfo:  name,
+		Namespace: namespace,
+	}
+	config.CurrentContext = name
+	return clientcmd.Write(*config)
+}
+
+// serviceAccountToken creates the token secret of the kubectl service
+// account and waits for the token controller to fill it in
+func serviceAccountToken(namespace, label string) (string, error) {
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      kubectlTokenName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				UserNameLabel: label,
+			},
+			Annotations: map[string]string{
+				v1.ServiceAccountNameKey: kubectlName,
+			},
+		},
+		Type: v1.SecretTypeServiceAccountToken,
+	}
+	secrets := cfg.KubeClientset.CoreV1().Secrets(namespace)
+	if _, err := secrets.Create(secret); err != nil && !errors.IsAlreadyExists(err) {
+		return "", err
+	}
+
+	var token string
+	err := wait.PollImmediate(500*time.Millisecond, 30*time.Second, func() (bool, error) {
+		s, err := secrets.Get(kubectlTokenName, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		token = string(s.Data[v1.ServiceAccountTokenKey])
+		return len(token) > 0, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to get service account token: %v", err)
+	}
+	return token, nil
+}
@@ -0,0 +1,221 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+
+	"k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// NamespaceNameLabel lets network policies select a namespace by name
+	NamespaceNameLabel = "kubefy.io/namespace"
+
+	ingressPolicyName = "kubefy-allow-ingress"
+	egressPolicyName  = "kubefy-allow-egress"
+	dnsNamespace      = "kube-system"
+)
+
+// NetworkPeer is a namespace, optionally narrowed to pods with matching labels
+type NetworkPeer struct {
+	Namespace string
+	PodLabels map[string]string
+}
+
+// ParseNetworkPeers parses space separated peers of the form
+// namespace[/key=value,...], e.g. "rook-ceph/app=rook-ceph-rgw monitoring"
+func ParseNetworkPeers(s string) ([]NetworkPeer, error) {
+	var peers []NetworkPeer
+	for _, entry := range strings.Fields(s) {
+		parts := strings.SplitN(entry, "/", 2)
+		peer := NetworkPeer{Namespace: parts[0]}
+		if len(peer.Namespace) == 0 {
+			return nil, fmt.Errorf("invalid network peer %q", entry)
+		}
+		if len(parts) == 2 {
+			podLabels, err := labels.ConvertSelectorToLabelsMap(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid network peer %q: %v", entry, err)
+			}
+			peer.PodLabels = podLabels
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
+
+// CreateNetworkPolicies isolates a user namespace. Ingress is allowed from
+// the namespace itself, the system namespaces and the ingress allowlist. If
+// the cluster CIDRs are known, egress into the cluster is limited to the
+// namespace itself, the system namespaces and the egress allowlist.
+func CreateNetworkPolicies(namespace, label string, systemNamespaces []string, ingressAllowlist, egressAllowlist []NetworkPeer) error {
+	from, err := policyPeers(systemNamespaces, ingressAllowlist)
+	if err != nil {
+		return err
+	}
+
+	ingress := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      ingressPolicyName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				UserNameLabel: label,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+			Ingress: []networkingv1.NetworkPolicyIngressRule{
+				{From: from},
+			},
+		},
+	}
+	if err := applyNetworkPolicy(ingress); err != nil {
+		return err
+	}
+
+	clusterCIDRs := strings.Fields(cfg.ClusterCIDRs)
+	if len(clusterCIDRs) == 0 {
+		return nil
+	}
+	if err := labelNamespaceName(dnsNamespace); err != nil {
+		return err
+	}
+	to, err := policyPeers(systemNamespaces, egressAllowlist)
+	if err != nil {
+		return err
+	}
+	// plus anything outside the cluster
+	to = append(to, networkingv1.NetworkPolicyPeer{
+		IPBlock: &networkingv1.IPBlock{
+			CIDR:   "0.0.0.0/0",
+			Except: clusterCIDRs,
+		},
+	})
+	udp := v1.ProtocolUDP
+	tcp := v1.ProtocolTCP
+	dnsPort := intstr.FromInt(53)
+	egress := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      egressPolicyName,
+			Namespace: namespace,
+			Labels: map[string]string{
+				UserNameLabel: label,
+			},
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeEgress},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To: to,
+				},
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						policyPeer(NetworkPeer{Namespace: dnsNamespace}),
+					},
+					Ports: []networkingv1.NetworkPolicyPort{
+						{Protocol: &udp, Port: &dnsPort},
+						{Protocol: &tcp, Port: &dnsPort},
+					},
+				},
+			},
+		},
+	}
+	return applyNetworkPolicy(egress)
+}
+
+// policyPeers returns the system namespaces, the allowlist and the namespace
+// itself as policy peers. Missing namespaces are skipped.
+func policyPeers(systemNamespaces []string, allowlist []NetworkPeer) ([]networkingv1.NetworkPolicyPeer, error) {
+	peers := []NetworkPeer{}
+	for _, ns := range systemNamespaces {
+		peers = append(peers, NetworkPeer{Namespace: ns})
+	}
+	peers = append(peers, allowlist...)
+
+	// namespaces are selected by label, make sure the peers carry it
+	var policyPeers []networkingv1.NetworkPolicyPeer
+	for _, peer := range peers {
+		if err := labelNamespaceName(peer.Namespace); err != nil {
+			if errors.IsNotFound(err) {
+				glog.Warningf("network peer namespace %s does not exist", peer.Namespace)
+				continue
+			}
+			return nil, err
+		}
+		policyPeers = append(policyPeers, policyPeer(peer))
+	}
+	// the namespace itself
+	policyPeers = append(policyPeers, networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}})
+	return policyPeers, nil
+}
+
+func policyPeer(peer NetworkPeer) networkingv1.NetworkPolicyPeer {
+	p := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{
+			MatchLabels: map[string]string{
+				NamespaceNameLabel: peer.Namespace,
+			},
+		},
+	}
+	if len(peer.PodLabels) > 0 {
+		p.PodSelector = &metav1.LabelSelector{MatchLabels: peer.PodLabels}
+	}
+	return p
+}
+
+// labelNamespaceName labels a namespace with its own name
+func labelNamespaceName(namespace string) error {
+	client := cfg.KubeClientset.CoreV1().Namespaces()
+	ns, err := client.Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if ns.Labels[NamespaceNameLabel] == namespace {
+		return nil
+	}
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	ns.Labels[NamespaceNameLabel] = namespace
+	_, err = client.Update(ns)
+	return err
+}
+
+func applyNetworkPolicy(policy *networkingv1.NetworkPolicy) error {
+	client := cfg.KubeClientset.NetworkingV1().NetworkPolicies(policy.Namespace)
+	old, err := client.Get(policy.Name, metav1.GetOptions{})
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		_, err = client.Create(policy)
+		return err
+	}
+	policy.ResourceVersion = old.ResourceVersion
+	_, err = client.Update(policy)
+	return err
+}
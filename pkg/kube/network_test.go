@@ -0,0 +1,68 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kube
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNetworkPeers(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []NetworkPeer
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{name: "blank", in: "  \t "},
+		{
+			name: "namespace",
+			in:   "monitoring",
+			want: []NetworkPeer{{Namespace: "monitoring"}},
+		},
+		{
+			name: "namespace and pod labels",
+			in:   "rook-ceph/app=rook-ceph-rgw,rook_object_store=store",
+			want: []NetworkPeer{{Namespace: "rook-ceph", PodLabels: map[string]string{"app": "rook-ceph-rgw", "rook_object_store": "store"}}},
+		},
+		{
+			name: "several peers",
+			in:   " monitoring  rook-ceph/app=rook-ceph-rgw ",
+			want: []NetworkPeer{
+				{Namespace: "monitoring"},
+				{Namespace: "rook-ceph", PodLabels: map[string]string{"app": "rook-ceph-rgw"}},
+			},
+		},
+		{name: "missing namespace", in: "/app=rgw", wantErr: true},
+		{name: "invalid labels", in: "rook-ceph/app", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseNetworkPeers(tt.in)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
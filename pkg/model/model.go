@@ -1,30 +1,240 @@
 package model
 
 type CreateUserRequest struct {
+	// UserName is at most 16 letters, digits and '-', since the user
+	// namespace is derived from it
 	UserName string `json:"userName"`
 	// docker setting
 	DockerId       string `json:"dockerId,omitempty"`
 	DockerPassword string `json:"dockerPassword,omitempty"`
+	// DockerRegistry defaults to the server registry setting
+	DockerRegistry string `json:"dockerRegistry,omitempty"`
 	// github setting
 	GithubId       string `json:"githubId,omitempty"`
 	GithubPassword string `json:"githubPassword,omitempty"`
+	// GithubSSHKey is a private key for ssh git urls
+	GithubSSHKey        string `json:"githubSshKey,omitempty"`
+	GithubSSHKnownHosts string `json:"githubSshKnownHosts,omitempty"`
+	// GitHost defaults to the server git host setting
+	GitHost string `json:"gitHost,omitempty"`
 }
 
 type CreateUserResponse struct {
+	// UserName is the user namespace, kept for older clients
+	UserName  string `json:"userName"`
+	Namespace string `json:"namespace,omitempty"`
+	Created   bool   `json:"created"`
+	// Token is only returned when the user is created
+	Token string `json:"token,omitempty"`
+}
+
+type TokenResponse struct {
 	UserName string `json:"userName"`
-	Error    string `json:"error,omitempty"`
+	Token    string `json:"token,omitempty"`
+}
+
+// ErrorResponse is the envelope of every failed request
+type ErrorResponse struct {
+	Error Error `json:"error"`
+}
+
+// Error is a machine readable error
+type Error struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+type User struct {
+	UserName  string `json:"userName"`
+	Namespace string `json:"namespace"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	DockerId  string `json:"dockerId,omitempty"`
+	GithubId  string `json:"githubId,omitempty"`
+	Plan      string `json:"plan,omitempty"`
+}
+
+type KubeconfigResponse struct {
+	UserName   string `json:"userName"`
+	Kubeconfig string `json:"kubeconfig,omitempty"`
+}
+
+type SetPlanRequest struct {
+	Plan string `json:"plan"`
+}
+
+type GetUserResponse struct {
+	User *User `json:"user,omitempty"`
+}
+
+type ListUsersResponse struct {
+	Users []User `json:"users"`
 }
 
 type CreateFunctionRequest struct {
 	CreateUserRequest
-	FunctionName   string `json:"functionName"`
-	GitRepo        string `json:"repo"`
-	RepoRevision   string `json:"revision,omitempty"`
+	ContainerSpec
+	BuildTemplateRef
+	SourceRef
+	FunctionName string `json:"functionName"`
+	// ContainerImage of a function built from source defaults to
+	// <registry>/<namespace>/<function>:<commit-or-timestamp>
 	ContainerImage string `json:"image,omitempty"`
 }
 
+// SourceRef is the source a function is built from, a git repo or an
+// uploaded source archive
+type SourceRef struct {
+	GitRepo      string `json:"repo"`
+	RepoRevision string `json:"revision,omitempty"`
+	// SourceArchive is the sha256 checksum of an uploaded source archive
+	SourceArchive string `json:"sourceArchive,omitempty"`
+}
+
+// SourceArchive is a source archive stored in the bucket of a user
+type SourceArchive struct {
+	Checksum string `json:"checksum"`
+	Format   string `json:"format"`
+	Size     int64  `json:"size"`
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	// Deduplicated is set if the same archive was uploaded before
+	Deduplicated bool `json:"deduplicated"`
+}
+
+type DeploySourceResponse struct {
+	UpdateFunctionResponse
+	Source SourceArchive `json:"source"`
+}
+
+// BuildTemplateRef selects the build template of a function built from git
+type BuildTemplateRef struct {
+	// BuildTemplate defaults to the server build template setting
+	BuildTemplate string `json:"buildTemplate,omitempty"`
+	// BuildTemplateKind is BuildTemplate or ClusterBuildTemplate, a
+	// BuildTemplate of the user wins over a ClusterBuildTemplate if empty
+	BuildTemplateKind string `json:"buildTemplateKind,omitempty"`
+	// BuildArguments are template parameters besides IMAGE, e.g. DOCKERFILE
+	BuildArguments map[string]string `json:"buildArguments,omitempty"`
+}
+
+// BuildTemplate is a build template available to a user
+type BuildTemplate struct {
+	Name       string              `json:"name"`
+	Kind       string              `json:"kind"`
+	Parameters []TemplateParameter `json:"parameters,omitempty"`
+}
+
+type TemplateParameter struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description,omitempty"`
+	Default     *string `json:"default,omitempty"`
+	Required    bool    `json:"required"`
+}
+
+// TemplateReport tells how well a build template fits what kfunc passes to it
+type TemplateReport struct {
+	Name      string `json:"name"`
+	Kind      string `json:"kind"`
+	Installed bool   `json:"installed"`
+	// Managed templates come from the kubefy catalog
+	Managed        bool     `json:"managed"`
+	CatalogVersion string   `json:"catalogVersion,omitempty"`
+	Images         []string `json:"images,omitempty"`
+	Compatible     bool     `json:"compatible"`
+	Issues         []string `json:"issues,omitempty"`
+	Notes          []string `json:"notes,omitempty"`
+}
+
+type TemplateReportResponse struct {
+	BuildTemplates []TemplateReport `json:"buildTemplates"`
+}
+
+type ListBuildTemplatesResponse struct {
+	BuildTemplates []BuildTemplate `json:"buildTemplates"`
+}
+
+// ContainerSpec is the part of the function revision template users can set.
+// On PATCH only the fields that are present in the body are changed.
+type ContainerSpec struct {
+	Env       []EnvVar        `json:"env,omitempty"`
+	EnvFrom   []EnvFromSource `json:"envFrom,omitempty"`
+	Resources *Resources      `json:"resources,omitempty"`
+	// ContainerConcurrency caps the requests a container serves at once, 0 is unlimited
+	ContainerConcurrency *int64 `json:"containerConcurrency,omitempty"`
+	TimeoutSeconds       *int64 `json:"timeoutSeconds,omitempty"`
+	Port                 *int32 `json:"port,omitempty"`
+	// Protocol is http1 or h2c
+	Protocol string   `json:"protocol,omitempty"`
+	Command  []string `json:"command,omitempty"`
+	Args     []string `json:"args,omitempty"`
+
+	Autoscaling *Autoscaling `json:"autoscaling,omitempty"`
+}
+
+// Autoscaling bounds the replicas of a function
+type Autoscaling struct {
+	MinScale *int32 `json:"minScale,omitempty"`
+	MaxScale *int32 `json:"maxScale,omitempty"`
+	// Target is the concurrency per replica with kpa, the cpu percent with hpa
+	Target *int32 `json:"target,omitempty"`
+	// Class is kpa or hpa
+	Class string `json:"class,omitempty"`
+}
+
+type ReplicasResponse struct {
+	FunctionName string             `json:"functionName"`
+	Revisions    []RevisionReplicas `json:"revisions"`
+}
+
+type RevisionReplicas struct {
+	Revision      string `json:"revision"`
+	Desired       int32  `json:"desired"`
+	Replicas      int32  `json:"replicas"`
+	ReadyReplicas int32  `json:"readyReplicas"`
+}
+
+// Resources are the cpu and memory quantities of a container, e.g. 500m and 1Gi
+type Resources struct {
+	Requests ResourceList `json:"requests,omitempty"`
+	Limits   ResourceList `json:"limits,omitempty"`
+}
+
+type ResourceList struct {
+	CPU    string `json:"cpu,omitempty"`
+	Memory string `json:"memory,omitempty"`
+}
+
+// EnvVar is set from Value, or from a key of a Secret or ConfigMap of the user
+type EnvVar struct {
+	Name            string  `json:"name"`
+	Value           string  `json:"value,omitempty"`
+	SecretKeyRef    *KeyRef `json:"secretKeyRef,omitempty"`
+	ConfigMapKeyRef *KeyRef `json:"configMapKeyRef,omitempty"`
+}
+
+type KeyRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+// EnvFromSource sets an env var for each key of a Secret or ConfigMap
+type EnvFromSource struct {
+	Prefix       string `json:"prefix,omitempty"`
+	SecretRef    string `json:"secretRef,omitempty"`
+	ConfigMapRef string `json:"configMapRef,omitempty"`
+}
+
 type CreateFunctionResponse struct {
-	Error string `json:"error,omitempty"`
+}
+
+type UpdateFunctionResponse struct {
+	FunctionName string `json:"functionName"`
+	Generation   int64  `json:"generation"`
+	// Revision is the Revision created by the update, empty if Knative
+	// did not report it in time
+	Revision         string `json:"revision,omitempty"`
+	PreviousRevision string `json:"previousRevision,omitempty"`
 }
 
 type GetFunctionRequest struct {
@@ -33,9 +243,219 @@ type GetFunctionRequest struct {
 }
 
 type GetFunctionResponse struct {
+	ContainerSpec
 	Endpoints []Endpoint `json:"endpoints"`
 	Authority string     `json:"authoriy"`
-	Error     string     `json:"error,omitempty"`
+	// Traffic is the split between the current and candidate revisions
+	Traffic       []TrafficTarget `json:"traffic,omitempty"`
+	CurrentHost   string          `json:"currentHost,omitempty"`
+	CandidateHost string          `json:"candidateHost,omitempty"`
+	Status        *FunctionStatus `json:"status,omitempty"`
+}
+
+// FunctionStatus tells whether a function is ready and why it is not
+type FunctionStatus struct {
+	Ready bool `json:"ready"`
+	// Failed is set once Knative gave up on the latest generation
+	Failed                  bool        `json:"failed,omitempty"`
+	Conditions              []Condition `json:"conditions,omitempty"`
+	ConfigurationConditions []Condition `json:"configurationConditions,omitempty"`
+	RouteConditions         []Condition `json:"routeConditions,omitempty"`
+	LatestRevision          string      `json:"latestRevision,omitempty"`
+	// Pods are the pods of the latest revision
+	Pods []PodStatus `json:"pods,omitempty"`
+}
+
+type PodStatus struct {
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	// Reason is why a container is waiting or terminated, e.g. CrashLoopBackOff
+	Reason  string `json:"reason,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type TrafficTarget struct {
+	Name         string `json:"name,omitempty"`
+	RevisionName string `json:"revisionName"`
+	Percent      int    `json:"percent"`
+	// Host reaches the revision directly through its subroute
+	Host string `json:"host,omitempty"`
+}
+
+type RolloutRequest struct {
+	// Candidate is a revision name, or @latest for the latest created revision
+	Candidate string `json:"candidate,omitempty"`
+	Percent   int    `json:"percent"`
+}
+
+// Rollout is the release state of a function
+type Rollout struct {
+	FunctionName string          `json:"functionName"`
+	Current      string          `json:"current,omitempty"`
+	Candidate    string          `json:"candidate,omitempty"`
+	Percent      int             `json:"percent"`
+	Traffic      []TrafficTarget `json:"traffic,omitempty"`
+	// CurrentHost and CandidateHost reach the revisions of a release directly
+	CurrentHost   string `json:"currentHost,omitempty"`
+	CandidateHost string `json:"candidateHost,omitempty"`
+	// Progress is set for rollouts stepped by the server
+	Progress *Progress `json:"progress,omitempty"`
+}
+
+const (
+	RolloutProgressing = "progressing"
+	RolloutSucceeded   = "succeeded"
+	RolloutRolledBack  = "rolledback"
+	// RolloutFailed rollouts were rolled back because their state was invalid
+	RolloutFailed = "failed"
+)
+
+type ProgressiveRolloutRequest struct {
+	// Candidate is a revision name, or @latest for the latest created revision
+	Candidate string `json:"candidate,omitempty"`
+	// Steps are the candidate traffic percents, 5, 25, 50 and 100 by default
+	Steps []int `json:"steps,omitempty"`
+	// Interval is the time spent on each step, 5m by default
+	Interval string `json:"interval,omitempty"`
+	// ProbePath is requested on the candidate through the ingress gateway
+	ProbePath   string `json:"probePath,omitempty"`
+	MaxRestarts int    `json:"maxRestarts,omitempty"`
+}
+
+// Progress is the state of a progressive rollout
+type Progress struct {
+	Steps        []int  `json:"steps"`
+	Interval     string `json:"interval"`
+	ProbePath    string `json:"probePath,omitempty"`
+	MaxRestarts  int    `json:"maxRestarts"`
+	State        string `json:"state"`
+	Message      string `json:"message,omitempty"`
+	LastStepTime string `json:"lastStepTime,omitempty"`
+}
+
+type DeleteUserRequest struct {
+	UserName string `json:"userName"`
+	DryRun   bool   `json:"dryRun,omitempty"`
+}
+
+type DeleteUserResponse struct {
+	UserName  string           `json:"userName"`
+	DryRun    bool             `json:"dryRun,omitempty"`
+	Resources []ResourceStatus `json:"resources"`
+}
+
+const (
+	StatusDeleted     = "deleted"
+	StatusWouldDelete = "would delete"
+	StatusFailed      = "failed"
+)
+
+// ResourceStatus reports the progress of deleting one resource
+type ResourceStatus struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+type DeleteFunctionRequest struct {
+	CreateUserRequest
+	FunctionName string `json:"functionName"`
+}
+
+type DeleteFunctionResponse struct {
+	FunctionResources
+}
+
+// FunctionResources lists the Knative objects that back a function
+type FunctionResources struct {
+	Service        string   `json:"service,omitempty"`
+	Configurations []string `json:"configurations,omitempty"`
+	Revisions      []string `json:"revisions,omitempty"`
+	Builds         []string `json:"builds,omitempty"`
+}
+
+// Function is the summary of a Knative Service
+type Function struct {
+	Name                  string      `json:"name"`
+	Namespace             string      `json:"namespace"`
+	Domain                string      `json:"domain,omitempty"`
+	Ready                 bool        `json:"ready"`
+	Conditions            []Condition `json:"conditions,omitempty"`
+	LatestCreatedRevision string      `json:"latestCreatedRevision,omitempty"`
+	LatestReadyRevision   string      `json:"latestReadyRevision,omitempty"`
+	Image                 string      `json:"image,omitempty"`
+	// Source is set for functions built from git
+	Source *GitSource `json:"source,omitempty"`
+	// SourceArchive is set for functions built from an uploaded archive
+	SourceArchive string `json:"sourceArchive,omitempty"`
+}
+
+type GitSource struct {
+	Url      string `json:"url"`
+	Revision string `json:"revision,omitempty"`
+}
+
+type Condition struct {
+	Type               string `json:"type"`
+	Status             string `json:"status"`
+	Reason             string `json:"reason,omitempty"`
+	Message            string `json:"message,omitempty"`
+	LastTransitionTime string `json:"lastTransitionTime,omitempty"`
+}
+
+type ListFunctionsResponse struct {
+	Functions []Function `json:"functions"`
+	// Continue is passed back to get the next page
+	Continue string `json:"continue,omitempty"`
+}
+
+type Revision struct {
+	Name       string `json:"name"`
+	Generation int64  `json:"generation,omitempty"`
+	Image      string `json:"image,omitempty"`
+	CreatedAt  string `json:"createdAt,omitempty"`
+	Ready      bool   `json:"ready"`
+	// Build is the Build that produced the image, if any
+	Build string `json:"build,omitempty"`
+}
+
+type RollbackRequest struct {
+	Revision string `json:"revision"`
+}
+
+type ListRevisionsResponse struct {
+	Revisions []Revision `json:"revisions"`
+}
+
+// Build is the status of a Knative Build of a function
+type Build struct {
+	Name           string      `json:"name"`
+	Succeeded      string      `json:"succeeded"`
+	Conditions     []Condition `json:"conditions,omitempty"`
+	StartTime      string      `json:"startTime,omitempty"`
+	CompletionTime string      `json:"completionTime,omitempty"`
+	Duration       string      `json:"duration,omitempty"`
+	PodName        string      `json:"podName,omitempty"`
+	Steps          []BuildStep `json:"steps,omitempty"`
+}
+
+type BuildStep struct {
+	Name string `json:"name"`
+	// State is waiting, running or terminated
+	State      string `json:"state"`
+	Reason     string `json:"reason,omitempty"`
+	Message    string `json:"message,omitempty"`
+	ExitCode   int32  `json:"exitCode,omitempty"`
+	StartedAt  string `json:"startedAt,omitempty"`
+	FinishedAt string `json:"finishedAt,omitempty"`
+}
+
+type ListBuildsResponse struct {
+	Builds []Build `json:"builds"`
 }
 
 type Endpoint struct {
@@ -52,5 +472,4 @@ type CreateStorageResponse struct {
 	S3Endpoint  []Endpoint `json:"s3endpoint,omitempty"`
 	S3AccessKey string     `json:"s3access,omitempty"`
 	S3SecretKey string     `json:"s3secret,omitempty"`
-	Error       string     `json:"error,omitempty"`
 }
@@ -0,0 +1,292 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kube"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// PlanLabel records the plan of a user namespace
+	PlanLabel = "kubefy.io/plan"
+
+	quotaName      = "kubefy-quota"
+	limitRangeName = "kubefy-limits"
+)
+
+// Plan is a tenant plan, it caps what a user namespace can consume
+type Plan struct {
+	Name string `json:"name"`
+
+	// namespace totals
+	RequestsCPU    string `json:"requestsCpu"`
+	RequestsMemory string `json:"requestsMemory"`
+	LimitsCPU      string `json:"limitsCpu"`
+	LimitsMemory   string `json:"limitsMemory"`
+	Pods           int64  `json:"pods"`
+	Services       int64  `json:"services"`
+	Secrets        int64  `json:"secrets"`
+
+	// per container defaults and maximum
+	DefaultCPU           string `json:"defaultCpu"`
+	DefaultMemory        string `json:"defaultMemory"`
+	DefaultRequestCPU    string `json:"defaultRequestCpu"`
+	DefaultRequestMemory string `json:"defaultRequestMemory"`
+	MaxCPU               string `json:"maxCpu"`
+	MaxMemory            string `json:"maxMemory"`
+
+	// per function autoscaling caps, MaxMinScale 0 enforces scale to zero
+	// and MaxMaxScale 0 leaves maxScale to the pod quota
+	MaxMinScale int32 `json:"maxMinScale"`
+	MaxMaxScale int32 `json:"maxMaxScale"`
+}
+
+// Plans is the layout of the plans file
+type Plans struct {
+	DefaultPlan string `json:"defaultPlan"`
+	Plans       []Plan `json:"plans"`
+}
+
+var (
+	defaultPlan = "free"
+	plans       = map[string]*Plan{
+		"free": {
+			Name:                 "free",
+			RequestsCPU:          "2",
+			RequestsMemory:       "2Gi",
+			LimitsCPU:            "4",
+			LimitsMemory:         "4Gi",
+			Pods:                 20,
+			Services:             30,
+			Secrets:              20,
+			DefaultCPU:           "500m",
+			DefaultMemory:        "256Mi",
+			DefaultRequestCPU:    "100m",
+			DefaultRequestMemory: "64Mi",
+			MaxCPU:               "1",
+			MaxMemory:            "1Gi",
+			MaxMinScale:          0,
+			MaxMaxScale:          5,
+		},
+		"pro": {
+			Name:                 "pro",
+			RequestsCPU:          "8",
+			RequestsMemory:       "16Gi",
+			LimitsCPU:            "16",
+			LimitsMemory:         "32Gi",
+			Pods:                 100,
+			Services:             150,
+			Secrets:              100,
+			DefaultCPU:           "1",
+			DefaultMemory:        "512Mi",
+			DefaultRequestCPU:    "200m",
+			DefaultRequestMemory: "128Mi",
+			MaxCPU:               "4",
+			MaxMemory:            "8Gi",
+			MaxMinScale:          3,
+			MaxMaxScale:          50,
+		},
+	}
+)
+
+// Load replaces the built-in plans with the plans of a YAML or JSON file
+func Load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var p Plans
+	if err = yaml.Unmarshal(data, &p); err != nil {
+		return err
+	}
+	loaded := map[string]*Plan{}
+	for i := range p.Plans {
+		if err = p.Plans[i].validate(); err != nil {
+			return err
+		}
+		loaded[p.Plans[i].Name] = &p.Plans[i]
+	}
+	if _, ok := loaded[p.DefaultPlan]; !ok {
+		return fmt.Errorf("default plan %q is not defined", p.DefaultPlan)
+	}
+	plans = loaded
+	defaultPlan = p.DefaultPlan
+	glog.Infof("loaded %d plans, default %s", len(plans), defaultPlan)
+	return nil
+}
+
+// Get returns a plan by name, or the default plan for an empty name
+func Get(name string) (*Plan, error) {
+	if len(name) == 0 {
+		name = defaultPlan
+	}
+	p, ok := plans[name]
+	if !ok {
+		return nil, errors.NewBadRequest(fmt.Sprintf("unknown plan %q", name))
+	}
+	return p, nil
+}
+
+// ForNamespace returns the plan of a user namespace
+func ForNamespace(namespace string) (*Plan, error) {
+	ns, err := cfg.KubeClientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return Get(ns.Labels[PlanLabel])
+}
+
+// CheckResources makes sure the requests and limits of a container fit in the
+// per container maximum of the plan
+func (p *Plan) CheckResources(requests, limits v1.ResourceList) error {
+	max := v1.ResourceList{
+		v1.ResourceCPU:    resource.MustParse(p.MaxCPU),
+		v1.ResourceMemory: resource.MustParse(p.MaxMemory),
+	}
+	for _, list := range []v1.ResourceList{requests, limits} {
+		for name, q := range list {
+			if m, ok := max[name]; ok && q.Cmp(m) > 0 {
+				return errors.NewBadRequest(fmt.Sprintf("%s %s is above the %s maximum of plan %s", name, q.String(), m.String(), p.Name))
+			}
+		}
+	}
+	for name, q := range requests {
+		if l, ok := limits[name]; ok && q.Cmp(l) > 0 {
+			return errors.NewBadRequest(fmt.Sprintf("%s request %s is above the limit %s", name, q.String(), l.String()))
+		}
+	}
+	return nil
+}
+
+// CheckScale makes sure the autoscaling bounds of a function fit in the plan,
+// a nil bound is not set
+func (p *Plan) CheckScale(minScale, maxScale *int32) error {
+	if minScale != nil && *minScale > p.MaxMinScale {
+		return errors.NewBadRequest(fmt.Sprintf("minScale %d is above the maximum %d of plan %s", *minScale, p.MaxMinScale, p.Name))
+	}
+	if maxScale != nil && p.MaxMaxScale > 0 && (*maxScale == 0 || *maxScale > p.MaxMaxScale) {
+		return errors.NewBadRequest(fmt.Sprintf("maxScale must be between 1 and %d on plan %s", p.MaxMaxScale, p.Name))
+	}
+	return nil
+}
+
+// List returns all plans sorted by name
+func List() []Plan {
+	var list []Plan
+	for _, p := range plans {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// Apply creates or updates the ResourceQuota and LimitRange of a user namespace
+func Apply(namespace, label string, p *Plan) error {
+	meta := metav1.ObjectMeta{
+		Namespace: namespace,
+		Labels: map[string]string{
+			kube.UserNameLabel: label,
+			PlanLabel:          p.Name,
+		},
+	}
+
+	quota := &v1.ResourceQuota{ObjectMeta: meta}
+	quota.Name = quotaName
+	quota.Spec.Hard = v1.ResourceList{
+		v1.ResourceRequestsCPU:    resource.MustParse(p.RequestsCPU),
+		v1.ResourceRequestsMemory: resource.MustParse(p.RequestsMemory),
+		v1.ResourceLimitsCPU:      resource.MustParse(p.LimitsCPU),
+		v1.ResourceLimitsMemory:   resource.MustParse(p.LimitsMemory),
+		v1.ResourcePods:           *resource.NewQuantity(p.Pods, resource.DecimalSI),
+		v1.ResourceServices:       *resource.NewQuantity(p.Services, resource.DecimalSI),
+		v1.ResourceSecrets:        *resource.NewQuantity(p.Secrets, resource.DecimalSI),
+	}
+	quotas := cfg.KubeClientset.CoreV1().ResourceQuotas(namespace)
+	if old, err := quotas.Get(quotaName, metav1.GetOptions{}); err == nil {
+		quota.ResourceVersion = old.ResourceVersion
+		_, err = quotas.Update(quota)
+		if err != nil {
+			return err
+		}
+	} else if !errors.IsNotFound(err) {
+		return err
+	} else if _, err = quotas.Create(quota); err != nil {
+		return err
+	}
+
+	limits := &v1.LimitRange{ObjectMeta: meta}
+	limits.Name = limitRangeName
+	limits.Spec.Limits = []v1.LimitRangeItem{
+		{
+			Type: v1.LimitTypeContainer,
+			Default: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(p.DefaultCPU),
+				v1.ResourceMemory: resource.MustParse(p.DefaultMemory),
+			},
+			DefaultRequest: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(p.DefaultRequestCPU),
+				v1.ResourceMemory: resource.MustParse(p.DefaultRequestMemory),
+			},
+			Max: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(p.MaxCPU),
+				v1.ResourceMemory: resource.MustParse(p.MaxMemory),
+			},
+		},
+	}
+	limitRanges := cfg.KubeClientset.CoreV1().LimitRanges(namespace)
+	if old, err := limitRanges.Get(limitRangeName, metav1.GetOptions{}); err == nil {
+		limits.ResourceVersion = old.ResourceVersion
+		_, err = limitRanges.Update(limits)
+		return err
+	} else if !errors.IsNotFound(err) {
+		return err
+	}
+	_, err := limitRanges.Create(limits)
+	return err
+}
+
+// validate makes sure the quantities parse, Apply relies on it
+func (p *Plan) validate() error {
+	if len(p.Name) == 0 {
+		return fmt.Errorf("plan name is missing")
+	}
+	if p.MaxMinScale < 0 || p.MaxMaxScale < 0 {
+		return fmt.Errorf("plan %s: scale caps must not be negative", p.Name)
+	}
+	for _, q := range []string{
+		p.RequestsCPU, p.RequestsMemory, p.LimitsCPU, p.LimitsMemory,
+		p.DefaultCPU, p.DefaultMemory, p.DefaultRequestCPU, p.DefaultRequestMemory,
+		p.MaxCPU, p.MaxMemory,
+	} {
+		if _, err := resource.ParseQuantity(q); err != nil {
+			return fmt.Errorf("plan %s: invalid quantity %q: %v", p.Name, q, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package plan
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func TestCheckScale(t *testing.T) {
+	free := plans["free"]
+	pro := plans["pro"]
+	unbounded := &Plan{Name: "unbounded", MaxMinScale: 10}
+	tests := []struct {
+		name     string
+		plan     *Plan
+		minScale *int32
+		maxScale *int32
+		wantErr  bool
+	}{
+		{name: "nothing set", plan: free},
+		{name: "scale to zero on free", plan: free, minScale: int32Ptr(0)},
+		{name: "minScale above free", plan: free, minScale: int32Ptr(1), wantErr: true},
+		{name: "minScale at pro maximum", plan: pro, minScale: int32Ptr(3)},
+		{name: "minScale above pro", plan: pro, minScale: int32Ptr(4), wantErr: true},
+		{name: "maxScale at free maximum", plan: free, maxScale: int32Ptr(5)},
+		{name: "maxScale above free", plan: free, maxScale: int32Ptr(6), wantErr: true},
+		{name: "unlimited maxScale on a capped plan", plan: free, maxScale: int32Ptr(0), wantErr: true},
+		{name: "both within pro", plan: pro, minScale: int32Ptr(2), maxScale: int32Ptr(50)},
+		{name: "unlimited maxScale without a cap", plan: unbounded, maxScale: int32Ptr(0)},
+		{name: "large maxScale without a cap", plan: unbounded, maxScale: int32Ptr(1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.plan.CheckScale(tt.minScale, tt.maxScale)
+			if tt.wantErr && !errors.IsBadRequest(err) {
+				t.Errorf("got error %v, want a bad request", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
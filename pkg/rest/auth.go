@@ -0,0 +1,120 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+
+	"github.com/kubefy/kubefy-server/pkg/auth"
+	kubefyuser "github.com/kubefy/kubefy-server/pkg/user"
+)
+
+// Authenticate checks the bearer token of every request and only lets a
+// token act on its own user namespace. Admin tokens may act on any namespace.
+func Authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		public := isPublic(r)
+		if public && len(r.Header.Get("Authorization")) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token := bearerToken(r)
+		if len(token) == 0 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			sendError(w, unauthorized("missing bearer token"), nil)
+			return
+		}
+		id, err := auth.Verify(token)
+		if err == auth.ErrInvalidToken {
+			glog.Warningf("invalid token for %s %s", r.Method, r.URL.Path)
+			w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\"")
+			sendError(w, unauthorized("%v", err), nil)
+			return
+		}
+		if err != nil {
+			sendError(w, err, nil)
+			return
+		}
+		r = r.WithContext(auth.WithIdentity(r.Context(), id))
+
+		if !public && !id.Admin {
+			userName, err := requestUser(r)
+			if err != nil {
+				sendError(w, badRequest("failed to parse body: %v", err), nil)
+				return
+			}
+			// do not tell apart unknown users from users of other tenants
+			namespace, err := kubefyuser.ResolveNamespace(userName)
+			if err != nil || !id.Allowed(namespace) {
+				glog.Warningf("token of %s is not allowed on user %q", id.Namespace, userName)
+				sendError(w, forbidden("token is not allowed to act on this user"), nil)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isPublic returns true for the routes that can be called without a token
+func isPublic(r *http.Request) bool {
+	if r.URL.Path == "/" {
+		return true
+	}
+	return r.Method == http.MethodPost && (r.URL.Path == "/users" || r.URL.Path == "/api/v1/users")
+}
+
+func bearerToken(r *http.Request) string {
+	const prefix = "bearer "
+	h := r.Header.Get("Authorization")
+	if len(h) < len(prefix) || !strings.EqualFold(h[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(h[len(prefix):])
+}
+
+// requestUser returns the user a request acts on, from the route or from
+// the userName of the JSON body. The body is restored for the handler.
+func requestUser(r *http.Request) (string, error) {
+	if name, ok := mux.Vars(r)["user"]; ok {
+		return name, nil
+	}
+	if r.Body == nil {
+		return "", nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
+	if err != nil {
+		return "", err
+	}
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var req struct {
+		UserName string `json:"userName"`
+	}
+	if len(body) != 0 {
+		if err = json.Unmarshal(body, &req); err != nil {
+			return "", err
+		}
+	}
+	return req.UserName, nil
+}
@@ -0,0 +1,148 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/glog"
+
+	"github.com/kubefy/kubefy-server/pkg/model"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Error is a failed request and the HTTP status it is sent with. Codes
+// follow the Kubernetes status reasons so API errors pass through as is.
+type Error struct {
+	Status  int
+	Code    metav1.StatusReason
+	Message string
+	Details interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func newError(status int, code metav1.StatusReason, format string, args ...interface{}) *Error {
+	return &Error{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func badRequest(format string, args ...interface{}) *Error {
+	return newError(http.StatusBadRequest, metav1.StatusReasonBadRequest, format, args...)
+}
+
+func unauthorized(format string, args ...interface{}) *Error {
+	return newError(http.StatusUnauthorized, metav1.StatusReasonUnauthorized, format, args...)
+}
+
+func forbidden(format string, args ...interface{}) *Error {
+	return newError(http.StatusForbidden, metav1.StatusReasonForbidden, format, args...)
+}
+
+func conflict(format string, args ...interface{}) *Error {
+	return newError(http.StatusConflict, metav1.StatusReasonAlreadyExists, format, args...)
+}
+
+func tooLarge(format string, args ...interface{}) *Error {
+	return newError(http.StatusRequestEntityTooLarge, metav1.StatusReason("RequestEntityTooLarge"), format, args...)
+}
+
+// toError maps err to an Error. Kubernetes API errors keep their reason and
+// details, anything else is an internal error.
+func toError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	e := &Error{
+		Status:  http.StatusInternalServerError,
+		Code:    metav1.StatusReasonInternalError,
+		Message: err.Error(),
+	}
+	apiStatus, ok := err.(errors.APIStatus)
+	if !ok {
+		return e
+	}
+	status := apiStatus.Status()
+	switch {
+	case errors.IsNotFound(err):
+		e.Status = http.StatusNotFound
+	case errors.IsAlreadyExists(err), errors.IsConflict(err):
+		e.Status = http.StatusConflict
+	case errors.IsForbidden(err):
+		e.Status = http.StatusForbidden
+	case errors.IsUnauthorized(err):
+		e.Status = http.StatusUnauthorized
+	case errors.IsBadRequest(err):
+		e.Status = http.StatusBadRequest
+	case errors.IsInvalid(err):
+		e.Status = http.StatusUnprocessableEntity
+	case errors.IsTimeout(err), errors.IsServerTimeout(err):
+		e.Status = http.StatusGatewayTimeout
+	case errors.IsTooManyRequests(err):
+		e.Status = http.StatusTooManyRequests
+	case status.Code >= http.StatusBadRequest:
+		e.Status = int(status.Code)
+	}
+	if len(status.Reason) > 0 {
+		e.Code = status.Reason
+	}
+	if status.Details != nil {
+		e.Details = status.Details
+	}
+	return e
+}
+
+// sendJSON sends rep with status
+func sendJSON(w http.ResponseWriter, status int, rep interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(rep); err != nil {
+		glog.Warningf("failed to send response: %v", err)
+	}
+}
+
+func sendOK(w http.ResponseWriter, rep interface{}) {
+	sendJSON(w, http.StatusOK, rep)
+}
+
+func sendCreated(w http.ResponseWriter, rep interface{}) {
+	sendJSON(w, http.StatusCreated, rep)
+}
+
+// sendError sends err in the error envelope. details, if any, replace the
+// error details, e.g. to report partial progress.
+func sendError(w http.ResponseWriter, err error, details interface{}) {
+	e := toError(err)
+	glog.Warningf("request failed with %d %s: %s", e.Status, e.Code, e.Message)
+	rep := model.ErrorResponse{
+		Error: model.Error{
+			Code:    string(e.Code),
+			Message: e.Message,
+			Details: e.Details,
+		},
+	}
+	if details != nil {
+		rep.Error.Details = details
+	}
+	sendJSON(w, e.Status, rep)
+}
@@ -6,52 +6,49 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"k8s.io/apimachinery/pkg/api/errors"
 
+	"github.com/kubefy/kubefy-server/pkg/auth"
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
 	"github.com/kubefy/kubefy-server/pkg/kfunc"
 	"github.com/kubefy/kubefy-server/pkg/kube"
 	"github.com/kubefy/kubefy-server/pkg/model"
 	"github.com/kubefy/kubefy-server/pkg/storage"
+	kubefyuser "github.com/kubefy/kubefy-server/pkg/user"
 )
 
-func getRequest(w http.ResponseWriter, r *http.Request, req interface{}) error {
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1048576))
+const (
+	// maxWait bounds how long a request may wait for a function
+	maxWait = 10 * time.Minute
+	// maxRequestSize bounds JSON bodies, source archives have their own limit
+	maxRequestSize = 1048576
+)
+
+// getRequest parses the JSON body of r into req
+func getRequest(r *http.Request, req interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRequestSize))
 	if err != nil {
-		panic(err)
+		return badRequest("failed to read body: %v", err)
 	}
 	if err := r.Body.Close(); err != nil {
-		panic(err)
+		return badRequest("failed to read body: %v", err)
 	}
-	glog.Infof("body %+v", string(body))
 	if err := json.Unmarshal(body, req); err != nil {
-		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		glog.Warningf("failed to parse: %v", err)
-		w.WriteHeader(422)
-		msg := "error: " + err.Error()
-		if err := json.NewEncoder(w).Encode([]byte(msg)); err != nil {
-			panic(err)
-		}
+		return badRequest("failed to parse body: %v", err)
 	}
 	return nil
 }
 
-func sendResponse(w http.ResponseWriter, rep interface{}) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(rep); err != nil {
-		panic(err)
-	}
-}
-
-func sendError(w http.ResponseWriter, rep interface{}) {
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(422)
-	if err := json.NewEncoder(w).Encode(rep); err != nil {
-		panic(err)
-	}
+// pathVar returns a route variable, ok is false on routes without it
+func pathVar(r *http.Request, name string) (string, bool) {
+	v, ok := mux.Vars(r)[name]
+	return v, ok
 }
 
 func Root(w http.ResponseWriter, r *http.Request) {
@@ -63,52 +60,244 @@ func CreateUser(w http.ResponseWriter, r *http.Request) {
 		req model.CreateUserRequest
 		rep model.CreateUserResponse
 	)
-	if err := getRequest(w, r, &req); err != nil {
-		glog.Warningf("failed to get request. %+v", err)
-		rep.Error = err.Error()
-		sendError(w, rep)
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
 		return
 	}
 
 	// handle user here
-	u, err := uuid.NewRandom()
+	user, created, err := kubefyuser.Create(req)
 	if err != nil {
-		glog.Warningf("failed to get uuid. %+v", err)
-		rep.Error = err.Error()
-		sendError(w, rep)
+		glog.Warningf("failed to register user. %+v", err)
+		sendError(w, err, nil)
 		return
 	}
-	namespace := "kubefy-" + strings.ToLower(req.UserName) + "-" + u.String() + "-ns"
-	glog.Infof("created user %v", namespace)
-	if err = kube.CreateNamespace(namespace, req.UserName); err != nil {
-		glog.Warningf("failed to create namespace. %+v", err)
-		rep.Error = err.Error()
-		sendError(w, rep)
+	namespace := user.Namespace
+	glog.Infof("user %v has namespace %v, created %v", user.UserName, namespace, created)
+	if !created && !auth.FromRequest(r).Allowed(namespace) {
+		sendError(w, conflict("user %s already exists", user.UserName), nil)
 		return
 	}
+	// a new user that fails to get its token, secrets or service account is
+	// removed again, so that the client can simply retry
+	fail := func(err error) {
+		if created {
+			kubefyuser.Rollback(user)
+		}
+		sendError(w, err, nil)
+	}
+	if created {
+		if rep.Token, err = auth.IssueToken(namespace, user.UserName); err != nil {
+			glog.Warningf("failed to issue token. %+v", err)
+			fail(err)
+			return
+		}
+	}
 
 	dockerSecretName := "docker"
 	githubSecretName := "github"
+	githubSSHSecretName := "github-ssh"
+	var buildSecrets, pullSecrets []string
 	if len(req.DockerId) > 0 && len(req.DockerPassword) > 0 {
-		if err = kube.CreateSecret(namespace, req.UserName, dockerSecretName, req.DockerId, req.DockerPassword); err != nil {
+		registry := req.DockerRegistry
+		if len(registry) == 0 {
+			registry = cfg.DockerRegistry
+		}
+		if err = kube.CreateDockerConfigSecret(namespace, user.UserName, dockerSecretName, registry, req.DockerId, req.DockerPassword); err != nil {
 			glog.Warningf("failed to create docker secret. %+v", err)
-			rep.Error = err.Error()
-			sendError(w, rep)
+			fail(err)
 			return
 		}
+		buildSecrets = append(buildSecrets, dockerSecretName)
+		pullSecrets = append(pullSecrets, dockerSecretName)
+	}
+	gitHost := req.GitHost
+	if len(gitHost) == 0 {
+		gitHost = cfg.GitHost
 	}
 	if len(req.GithubId) > 0 && len(req.GithubPassword) > 0 {
-		if err = kube.CreateSecret(namespace, req.UserName, githubSecretName, req.GithubId, req.GithubPassword); err != nil {
+		if err = kube.CreateGitBasicAuthSecret(namespace, user.UserName, githubSecretName, gitHost, req.GithubId, req.GithubPassword); err != nil {
 			glog.Warningf("failed to create github secret. %+v", err)
-			rep.Error = err.Error()
-			sendError(w, rep)
+			fail(err)
+			return
+		}
+		buildSecrets = append(buildSecrets, githubSecretName)
+	}
+	if len(req.GithubSSHKey) > 0 {
+		if err = kube.CreateGitSSHSecret(namespace, user.UserName, githubSSHSecretName, gitHost, req.GithubSSHKey, req.GithubSSHKnownHosts); err != nil {
+			glog.Warningf("failed to create github ssh secret. %+v", err)
+			fail(err)
 			return
 		}
+		buildSecrets = append(buildSecrets, githubSSHSecretName)
+	}
+	// builds and function pods run as this service account
+	if err = kube.CreateServiceAccount(namespace, user.UserName, kube.ServiceAccountName, buildSecrets, pullSecrets); err != nil {
+		glog.Warningf("failed to create service account. %+v", err)
+		fail(err)
+		return
 	}
 
 	// response
 	rep.UserName = namespace
-	sendResponse(w, rep)
+	rep.Namespace = namespace
+	rep.Created = created
+	if created {
+		sendCreated(w, rep)
+	} else {
+		sendOK(w, rep)
+	}
+}
+
+func GetUser(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.GetUserResponse
+	)
+	name, _ := pathVar(r, "user")
+	user, err := kubefyuser.Get(name)
+	if err != nil {
+		glog.Warningf("failed to get user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.User = user
+	sendOK(w, rep)
+}
+
+func GetKubeconfig(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.KubeconfigResponse
+	)
+	name, _ := pathVar(r, "user")
+	rep.UserName = name
+	user, err := kubefyuser.Get(name)
+	if err != nil {
+		glog.Warningf("failed to get user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	kubeconfig, err := kube.CreateKubeconfig(user.Namespace, user.UserName)
+	if err != nil {
+		glog.Warningf("failed to create kubeconfig for %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Kubeconfig = string(kubeconfig)
+	sendOK(w, rep)
+}
+
+func SetUserPlan(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.SetPlanRequest
+		rep model.GetUserResponse
+	)
+	if !auth.FromRequest(r).Admin {
+		sendError(w, forbidden("only admins can change plans"), nil)
+		return
+	}
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	name, _ := pathVar(r, "user")
+	user, err := kubefyuser.SetPlan(name, req.Plan)
+	if err != nil {
+		glog.Warningf("failed to set plan of %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("user %v moved to plan %v", name, user.Plan)
+	rep.User = user
+	sendOK(w, rep)
+}
+
+func IssueToken(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.TokenResponse
+	)
+	name, _ := pathVar(r, "user")
+	rep.UserName = name
+	user, err := kubefyuser.Get(name)
+	if err == nil {
+		rep.Token, err = auth.IssueToken(user.Namespace, user.UserName)
+	}
+	if err != nil {
+		glog.Warningf("failed to issue token for %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("issued token for user %v", name)
+	sendCreated(w, rep)
+}
+
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.TokenResponse
+	)
+	name, _ := pathVar(r, "user")
+	rep.UserName = name
+	user, err := kubefyuser.Get(name)
+	if err == nil {
+		err = auth.RevokeToken(user.Namespace)
+	}
+	if err != nil {
+		glog.Warningf("failed to revoke token for %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("revoked token for user %v", name)
+	sendOK(w, rep)
+}
+
+func DeleteUser(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.DeleteUserRequest
+		rep model.DeleteUserResponse
+	)
+	if name, ok := pathVar(r, "user"); ok {
+		req.UserName = name
+		req.DryRun, _ = strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	} else if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+
+	rep.UserName = req.UserName
+	rep.DryRun = req.DryRun
+	steps, err := kubefyuser.Delete(req.UserName, req.DryRun)
+	rep.Resources = steps
+	if err != nil {
+		glog.Warningf("failed to delete user %s: %v", req.UserName, err)
+		// report what was deleted before the failure
+		var details interface{}
+		if len(steps) > 0 {
+			details = rep
+		}
+		sendError(w, err, details)
+		return
+	}
+	glog.Infof("deleted user %v, dry run %v", req.UserName, req.DryRun)
+	sendOK(w, rep)
+}
+
+func ListUsers(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.ListUsersResponse
+	)
+	users, err := kubefyuser.List()
+	if err != nil {
+		glog.Warningf("failed to list users: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Users = []model.User{}
+	planName := r.URL.Query().Get("plan")
+	for _, user := range users {
+		if len(planName) == 0 || user.Plan == planName {
+			rep.Users = append(rep.Users, user)
+		}
+	}
+	sendOK(w, rep)
 }
 
 func CreateFunction(w http.ResponseWriter, r *http.Request) {
@@ -116,32 +305,194 @@ func CreateFunction(w http.ResponseWriter, r *http.Request) {
 		req model.CreateFunctionRequest
 		rep model.CreateFunctionResponse
 	)
-	if err := getRequest(w, r, &req); err != nil {
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
 		return
 	}
-	gitUrl := req.GitRepo
-	gitRevision := req.RepoRevision
-	funcName := req.FunctionName
-	image := req.ContainerImage
-	namespace := req.UserName
-	if len(gitUrl) > 0 {
-		if err := kfunc.DeploySrc2Svc(namespace, gitUrl, gitRevision, image, funcName); err != nil {
-			rep.Error = err.Error()
-			sendError(w, rep)
+	if name, ok := pathVar(r, "user"); ok {
+		req.UserName = name
+	}
+	namespace, err := kubefyuser.ResolveNamespace(req.UserName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", req.UserName, err)
+		sendError(w, err, nil)
+		return
+	}
+	if err := deployFunction(namespace, &req); err != nil {
+		glog.Warningf("failed to create functions: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("created function %v", req.FunctionName)
+	sendCreated(w, rep)
+}
+
+// deployFunction creates a function from a git repo or a container image
+func deployFunction(namespace string, req *model.CreateFunctionRequest) error {
+	if len(req.GitRepo) > 0 || len(req.SourceArchive) > 0 {
+		return kfunc.DeploySrc2Svc(namespace, req.SourceRef, req.ContainerImage, req.FunctionName, req.BuildTemplateRef, req.ContainerSpec)
+	}
+	if len(req.ContainerImage) > 0 {
+		return kfunc.DeployImg2Svc(namespace, req.ContainerImage, req.FunctionName, req.ContainerSpec)
+	}
+	return badRequest("repo or image is required")
+}
+
+// UpdateFunction changes a function in place. PUT replaces the image and
+// source and creates missing functions, PATCH only changes the given fields.
+func UpdateFunction(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.CreateFunctionRequest
+	)
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	if name, ok := pathVar(r, "user"); ok {
+		req.UserName = name
+		req.FunctionName, _ = pathVar(r, "function")
+	}
+	namespace, err := kubefyuser.ResolveNamespace(req.UserName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", req.UserName, err)
+		sendError(w, err, nil)
+		return
+	}
+	replace := r.Method == http.MethodPut
+	rep, err := kfunc.Update(namespace, req.FunctionName, req.SourceRef, req.ContainerImage, req.BuildTemplateRef, req.ContainerSpec, replace)
+	if errors.IsNotFound(err) && replace {
+		if err = deployFunction(namespace, &req); err != nil {
+			glog.Warningf("failed to create functions: %v", err)
+			sendError(w, err, nil)
 			return
 		}
-	} else {
-		if len(image) > 0 {
-			if err := kfunc.DeployImg2Svc(namespace, image, funcName); err != nil {
-				glog.Warningf("failed to create functions: %v", err)
-				rep.Error = err.Error()
-				sendError(w, rep)
+		glog.Infof("created function %v", req.FunctionName)
+		sendCreated(w, model.CreateFunctionResponse{})
+		return
+	}
+	if err != nil {
+		glog.Warningf("failed to update function %s: %v", req.FunctionName, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("updated function %v, revision %v", req.FunctionName, rep.Revision)
+	if len(rep.Revision) == 0 {
+		// the update is accepted, the new revision shows up in the function status
+		sendJSON(w, http.StatusAccepted, rep)
+		return
+	}
+	sendOK(w, rep)
+}
+
+// DeploySource stores the tar.gz or zip source archive of the multipart part
+// "archive" in the user bucket and builds the function from it, creating the
+// function if needed. The optional part "function" holds the other function
+// settings as JSON.
+func DeploySource(w http.ResponseWriter, r *http.Request) {
+	var (
+		req      model.CreateFunctionRequest
+		rep      model.DeploySourceResponse
+		uploaded bool
+	)
+	userName, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	namespace, err := kubefyuser.ResolveNamespace(userName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", userName, err)
+		sendError(w, err, nil)
+		return
+	}
+	parts, err := r.MultipartReader()
+	if err != nil {
+		sendError(w, badRequest("expected a multipart/form-data body: %v", err), nil)
+		return
+	}
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			sendError(w, badRequest("failed to read body: %v", err), nil)
+			return
+		}
+		switch part.FormName() {
+		case "archive":
+			if uploaded {
+				sendError(w, badRequest("only one archive can be uploaded"), nil)
+				return
+			}
+			rep.Source, err = storage.UploadSource(namespace, part, cfg.MaxSourceSize)
+			if err == storage.ErrSourceTooLarge {
+				err = tooLarge("source archive is larger than %d bytes", cfg.MaxSourceSize)
+			}
+			if err != nil {
+				glog.Warningf("failed to store source of %s/%s: %v", namespace, funcName, err)
+				sendError(w, err, nil)
+				return
+			}
+			uploaded = true
+		case "function":
+			body, err := ioutil.ReadAll(io.LimitReader(part, maxRequestSize))
+			if err != nil {
+				sendError(w, badRequest("failed to read function: %v", err), nil)
+				return
+			}
+			if err = json.Unmarshal(body, &req); err != nil {
+				sendError(w, badRequest("failed to parse function: %v", err), nil)
 				return
 			}
+		default:
+			sendError(w, badRequest("unexpected part %q", part.FormName()), nil)
+			return
 		}
+		part.Close()
 	}
-	glog.Infof("created function %v", req.FunctionName)
-	sendResponse(w, rep)
+	if !uploaded {
+		sendError(w, badRequest("archive is missing"), nil)
+		return
+	}
+
+	// the route names the function and the archive is its only source
+	req.UserName = userName
+	req.FunctionName = funcName
+	req.SourceRef = model.SourceRef{SourceArchive: rep.Source.Checksum}
+	update, err := kfunc.Update(namespace, funcName, req.SourceRef, req.ContainerImage, req.BuildTemplateRef, req.ContainerSpec, false)
+	if errors.IsNotFound(err) {
+		if err = deployFunction(namespace, &req); err != nil {
+			glog.Warningf("failed to create functions: %v", err)
+			sendError(w, err, nil)
+			return
+		}
+		glog.Infof("created function %v from source %v", funcName, rep.Source.Checksum)
+		rep.FunctionName = funcName
+		sendCreated(w, rep)
+		return
+	}
+	if err != nil {
+		glog.Warningf("failed to update function %s: %v", funcName, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("updated function %v from source %v, revision %v", funcName, rep.Source.Checksum, update.Revision)
+	rep.UpdateFunctionResponse = update
+	if len(rep.Revision) == 0 {
+		sendJSON(w, http.StatusAccepted, rep)
+		return
+	}
+	sendOK(w, rep)
+}
+
+// functionRequest fills the user and function names from the route, or
+// parses the JSON body into req on the deprecated body based routes
+func functionRequest(r *http.Request, userName, funcName *string, req interface{}) error {
+	name, ok := pathVar(r, "user")
+	if !ok {
+		return getRequest(r, req)
+	}
+	*userName = name
+	*funcName, _ = pathVar(r, "function")
+	return nil
 }
 
 func GetFunction(w http.ResponseWriter, r *http.Request) {
@@ -149,25 +500,107 @@ func GetFunction(w http.ResponseWriter, r *http.Request) {
 		req model.GetFunctionRequest
 		rep model.GetFunctionResponse
 	)
-	if err := getRequest(w, r, &req); err != nil {
+	if err := functionRequest(r, &req.UserName, &req.FunctionName, &req); err != nil {
+		sendError(w, err, nil)
 		return
 	}
 	funcName := req.FunctionName
-	namespace := req.UserName
+	namespace, err := kubefyuser.ResolveNamespace(req.UserName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", req.UserName, err)
+		sendError(w, err, nil)
+		return
+	}
+	var status model.FunctionStatus
+	if wait := r.URL.Query().Get("wait"); len(wait) > 0 {
+		timeout, err := parseWait(wait)
+		if err != nil {
+			sendError(w, err, nil)
+			return
+		}
+		if status, err = kfunc.WaitReady(namespace, funcName, timeout); err != nil {
+			glog.Warningf("failed to wait for function %s: %v", funcName, err)
+			sendError(w, err, status)
+			return
+		}
+	} else if status, err = kfunc.Status(namespace, funcName); err != nil {
+		glog.Warningf("failed to get function status: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Status = &status
 	if ep, authoriy, err := kfunc.View(namespace, funcName); err != nil {
 		glog.Warningf("failed to get function: %v", err)
-		rep.Error = err.Error()
-		sendError(w, rep)
+		sendError(w, err, nil)
 		return
 	} else {
 		rep.Endpoints = ep
 		rep.Authority = authoriy
 	}
+	if rep.ContainerSpec, err = kfunc.GetContainer(namespace, funcName); err != nil {
+		glog.Warningf("failed to get function container: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rollout, err := kfunc.GetRollout(namespace, funcName)
+	if err != nil {
+		glog.Warningf("failed to get function traffic: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Traffic = rollout.Traffic
+	rep.CurrentHost = rollout.CurrentHost
+	rep.CandidateHost = rollout.CandidateHost
 
-	sendResponse(w, rep)
+	sendOK(w, rep)
+}
+
+// parseWait parses the wait query parameter, a duration like 90s or a number of seconds
+func parseWait(wait string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(wait)
+	if err != nil {
+		secs, serr := strconv.Atoi(wait)
+		if serr != nil {
+			return 0, badRequest("invalid wait %q", wait)
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	if timeout <= 0 || timeout > maxWait {
+		return 0, badRequest("wait must be between 0s and %v", maxWait)
+	}
+	return timeout, nil
 }
 
 func DeleteFunction(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.DeleteFunctionRequest
+		rep model.DeleteFunctionResponse
+	)
+	if err := functionRequest(r, &req.UserName, &req.FunctionName, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	funcName := req.FunctionName
+	namespace, err := kubefyuser.ResolveNamespace(req.UserName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", req.UserName, err)
+		sendError(w, err, nil)
+		return
+	}
+	removed, err := kfunc.Delete(namespace, funcName)
+	rep.FunctionResources = removed
+	if err != nil {
+		glog.Warningf("failed to delete function: %v", err)
+		// report what was deleted before the failure
+		var details interface{}
+		if len(removed.Service) > 0 {
+			details = rep
+		}
+		sendError(w, err, details)
+		return
+	}
+	glog.Infof("deleted function %v", funcName)
+	sendOK(w, rep)
 }
 
 func CreateStorage(w http.ResponseWriter, r *http.Request) {
@@ -175,14 +608,22 @@ func CreateStorage(w http.ResponseWriter, r *http.Request) {
 		req model.CreateStorageRequest
 		rep model.CreateStorageResponse
 	)
-	if err := getRequest(w, r, &req); err != nil {
+	if name, ok := pathVar(r, "user"); ok {
+		req.UserName = name
+	} else if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
 		return
 	}
 
-	userName := req.UserName
-	if bucket, s3id, s3key, endpoint, err := storage.CreateStorage(userName); err != nil {
-		rep.Error = err.Error()
-		sendError(w, rep)
+	// storage is keyed by the user namespace
+	namespace, err := kubefyuser.ResolveNamespace(req.UserName)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", req.UserName, err)
+		sendError(w, err, nil)
+		return
+	}
+	if bucket, s3id, s3key, endpoint, err := storage.CreateStorage(namespace); err != nil {
+		sendError(w, err, nil)
 		return
 	} else {
 		glog.Infof("created bucket %v", bucket)
@@ -191,5 +632,337 @@ func CreateStorage(w http.ResponseWriter, r *http.Request) {
 		rep.S3AccessKey = s3id
 		rep.S3SecretKey = s3key
 	}
-	sendResponse(w, rep)
+	sendCreated(w, rep)
+}
+
+func ListFunctions(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep   model.ListFunctionsResponse
+		limit int64
+	)
+	name, _ := pathVar(r, "user")
+	query := r.URL.Query()
+	if l := query.Get("limit"); len(l) > 0 {
+		var err error
+		if limit, err = strconv.ParseInt(l, 10, 64); err != nil || limit < 0 {
+			sendError(w, badRequest("invalid limit %q", l), nil)
+			return
+		}
+	}
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	functions, next, err := kfunc.ListFunctions(namespace, query.Get("labelSelector"), limit, query.Get("continue"))
+	if err != nil {
+		glog.Warningf("failed to list functions of %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Functions = functions
+	if rep.Functions == nil {
+		rep.Functions = []model.Function{}
+	}
+	rep.Continue = next
+	sendOK(w, rep)
+}
+
+func GetRollout(w http.ResponseWriter, r *http.Request) {
+	rollout(w, r, func(namespace, funcName string) (model.Rollout, error) {
+		return kfunc.GetRollout(namespace, funcName)
+	})
+}
+
+// SetRollout makes a revision the candidate of a function and sets its
+// share of the traffic
+func SetRollout(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.RolloutRequest
+	)
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	rollout(w, r, func(namespace, funcName string) (model.Rollout, error) {
+		return kfunc.SetRollout(namespace, funcName, req.Candidate, req.Percent)
+	})
+}
+
+// StartProgressiveRollout hands the candidate of a function to the rollout
+// reconciler, which steps its traffic up while it stays healthy
+func StartProgressiveRollout(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.ProgressiveRolloutRequest
+	)
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	rollout(w, r, func(namespace, funcName string) (model.Rollout, error) {
+		return kfunc.StartProgressive(namespace, funcName, req)
+	})
+}
+
+// Rollback sends all the traffic of a function to an older revision
+func Rollback(w http.ResponseWriter, r *http.Request) {
+	var (
+		req model.RollbackRequest
+	)
+	if err := getRequest(r, &req); err != nil {
+		sendError(w, err, nil)
+		return
+	}
+	rollout(w, r, func(namespace, funcName string) (model.Rollout, error) {
+		return kfunc.Rollback(namespace, funcName, req.Revision)
+	})
+}
+
+func RunLatest(w http.ResponseWriter, r *http.Request) {
+	rollout(w, r, kfunc.RunLatest)
+}
+
+func PromoteRollout(w http.ResponseWriter, r *http.Request) {
+	rollout(w, r, kfunc.Promote)
+}
+
+func AbortRollout(w http.ResponseWriter, r *http.Request) {
+	rollout(w, r, kfunc.Abort)
+}
+
+// rollout resolves the function of the route and replies with the rollout
+// state returned by call
+func rollout(w http.ResponseWriter, r *http.Request, call func(namespace, funcName string) (model.Rollout, error)) {
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep, err := call(namespace, funcName)
+	if err != nil {
+		glog.Warningf("failed rollout of %s: %v", funcName, err)
+		sendError(w, err, nil)
+		return
+	}
+	sendOK(w, rep)
+}
+
+func GetReplicas(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.ReplicasResponse
+	)
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	replicas, err := kfunc.Replicas(namespace, funcName)
+	if err != nil {
+		glog.Warningf("failed to get replicas of %s: %v", funcName, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.FunctionName = funcName
+	rep.Revisions = replicas
+	if rep.Revisions == nil {
+		rep.Revisions = []model.RevisionReplicas{}
+	}
+	sendOK(w, rep)
+}
+
+func ListBuilds(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.ListBuildsResponse
+	)
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	builds, err := kfunc.Builds(namespace, funcName)
+	if err != nil {
+		glog.Warningf("failed to list builds of %s: %v", funcName, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Builds = builds
+	if rep.Builds == nil {
+		rep.Builds = []model.Build{}
+	}
+	sendOK(w, rep)
+}
+
+func GetBuild(w http.ResponseWriter, r *http.Request) {
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	buildName, _ := pathVar(r, "build")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	build, err := kfunc.GetBuild(namespace, funcName, buildName)
+	if err != nil {
+		glog.Warningf("failed to get build %s: %v", buildName, err)
+		sendError(w, err, nil)
+		return
+	}
+	sendOK(w, build)
+}
+
+// StreamBuildLogs streams the logs of the build steps as server-sent events
+// when the client accepts text/event-stream, and as chunked text otherwise
+func StreamBuildLogs(w http.ResponseWriter, r *http.Request) {
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	buildName, _ := pathVar(r, "build")
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendError(w, fmt.Errorf("streaming is not supported"), nil)
+		return
+	}
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	// fail with a status code while one can still be sent
+	build, err := kfunc.GetBuild(namespace, funcName, buildName)
+	if err != nil {
+		glog.Warningf("failed to get build %s: %v", buildName, err)
+		sendError(w, err, nil)
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	send := func(event, data string) error {
+		var err error
+		if sse {
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		} else {
+			_, err = fmt.Fprintf(w, "[%s] %s\n", event, data)
+		}
+		flusher.Flush()
+		return err
+	}
+	err = kfunc.StreamBuildLogs(namespace, funcName, buildName, r.Context().Done(), send)
+	if err != nil {
+		glog.Warningf("failed to stream logs of build %s: %v", buildName, err)
+		send("error", err.Error())
+		return
+	}
+	if build, err = kfunc.GetBuild(namespace, funcName, buildName); err == nil {
+		send("end", "succeeded="+build.Succeeded)
+	}
+}
+
+func ListBuildTemplates(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.ListBuildTemplatesResponse
+	)
+	name, _ := pathVar(r, "user")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	templates, err := kfunc.ListTemplates(namespace)
+	if err != nil {
+		glog.Warningf("failed to list build templates: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.BuildTemplates = templates
+	if rep.BuildTemplates == nil {
+		rep.BuildTemplates = []model.BuildTemplate{}
+	}
+	sendOK(w, rep)
+}
+
+// BuildTemplateReport reports the compatibility of the cluster build templates
+func BuildTemplateReport(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.TemplateReportResponse
+	)
+	if !auth.FromRequest(r).Admin {
+		sendError(w, forbidden("only admins can list cluster build templates"), nil)
+		return
+	}
+	reports, err := kfunc.TemplateReport()
+	if err != nil {
+		glog.Warningf("failed to report build templates: %v", err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.BuildTemplates = reports
+	if rep.BuildTemplates == nil {
+		rep.BuildTemplates = []model.TemplateReport{}
+	}
+	sendOK(w, rep)
+}
+
+func ListRevisions(w http.ResponseWriter, r *http.Request) {
+	var (
+		rep model.ListRevisionsResponse
+	)
+	name, _ := pathVar(r, "user")
+	funcName, _ := pathVar(r, "function")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	revisions, err := kfunc.Revisions(namespace, funcName)
+	if err != nil {
+		glog.Warningf("failed to list revisions of %s: %v", funcName, err)
+		sendError(w, err, nil)
+		return
+	}
+	rep.Revisions = revisions
+	if rep.Revisions == nil {
+		rep.Revisions = []model.Revision{}
+	}
+	sendOK(w, rep)
+}
+
+func DeleteBucket(w http.ResponseWriter, r *http.Request) {
+	name, _ := pathVar(r, "user")
+	bucket, _ := pathVar(r, "bucket")
+	namespace, err := kubefyuser.ResolveNamespace(name)
+	if err != nil {
+		glog.Warningf("failed to resolve user %s: %v", name, err)
+		sendError(w, err, nil)
+		return
+	}
+	if err := storage.DeleteBucket(namespace, bucket); err != nil {
+		glog.Warningf("failed to delete bucket %s: %v", bucket, err)
+		sendError(w, err, nil)
+		return
+	}
+	glog.Infof("deleted bucket %v", bucket)
+	w.WriteHeader(http.StatusNoContent)
 }
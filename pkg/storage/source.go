@@ -0,0 +1,230 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/golang/glog"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kube"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/util"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	SourceTarGz = "tar.gz"
+	SourceZip   = "zip"
+
+	sourcePrefix = "sources/"
+	// sourceURLExpiry only has to cover the build started by a change, every
+	// change of a function signs a new url
+	sourceURLExpiry = time.Hour
+	formatMetadata  = "Format"
+)
+
+var (
+	// ErrSourceTooLarge is returned for archives above the size limit
+	ErrSourceTooLarge = fmt.Errorf("source archive is too large")
+
+	sourceResource = schema.GroupResource{Group: "kubefy.io", Resource: "sources"}
+	checksumFormat = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// UploadSource stores a tar.gz or zip source archive in the bucket of the
+// user, keyed by its sha256 checksum. An archive that is already stored is
+// not uploaded again.
+func UploadSource(userName string, archive io.Reader, maxSize int64) (model.SourceArchive, error) {
+	var (
+		source model.SourceArchive
+	)
+	// spool the archive, the checksum is only known once it is read
+	f, err := ioutil.TempFile("", "kubefy-source-")
+	if err != nil {
+		return source, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, hash), io.LimitReader(archive, maxSize+1))
+	if err != nil {
+		return source, errors.NewBadRequest(fmt.Sprintf("failed to read source archive: %v", err))
+	}
+	if size > maxSize {
+		return source, ErrSourceTooLarge
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return source, err
+	}
+	format, err := sourceFormat(f)
+	if err != nil {
+		return source, err
+	}
+	source = model.SourceArchive{
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		Format:   format,
+		Size:     size,
+		Bucket:   userName,
+	}
+	source.Key = sourcePrefix + source.Checksum
+
+	err = withBucket(userName, func(s3client *s3.S3) error {
+		_, err := s3client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(source.Bucket),
+			Key:    aws.String(source.Key),
+		})
+		if err == nil {
+			source.Deduplicated = true
+			return nil
+		}
+		if !isNotFound(err) {
+			return err
+		}
+		if _, err = f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err = s3client.PutObject(&s3.PutObjectInput{
+			Bucket:        aws.String(source.Bucket),
+			Key:           aws.String(source.Key),
+			Body:          f,
+			ContentLength: aws.Int64(size),
+			ContentType:   aws.String("application/octet-stream"),
+			Metadata:      map[string]*string{formatMetadata: aws.String(format)},
+		})
+		return err
+	})
+	if err != nil {
+		return source, err
+	}
+	glog.Infof("stored source archive %s/%s, %d bytes, deduplicated %v", source.Bucket, source.Key, size, source.Deduplicated)
+	return source, nil
+}
+
+// SourceURL returns a presigned url of a stored source archive and its format
+func SourceURL(userName, checksum string) (string, string, error) {
+	var (
+		url, format string
+	)
+	if !checksumFormat.MatchString(checksum) {
+		return url, format, errors.NewBadRequest("source archive must be a sha256 checksum")
+	}
+	key := sourcePrefix + checksum
+	err := withBucket(userName, func(s3client *s3.S3) error {
+		head, err := s3client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(userName),
+			Key:    aws.String(key),
+		})
+		if isNotFound(err) {
+			return errors.NewNotFound(sourceResource, checksum)
+		}
+		if err != nil {
+			return err
+		}
+		format = SourceTarGz
+		if f, ok := head.Metadata[formatMetadata]; ok && f != nil {
+			format = *f
+		}
+		req, _ := s3client.GetObjectRequest(&s3.GetObjectInput{
+			Bucket: aws.String(userName),
+			Key:    aws.String(key),
+		})
+		url, err = req.Presign(sourceURLExpiry)
+		return err
+	})
+	return url, format, err
+}
+
+// ObjectStorePeer returns the object store gateway pods, which build steps
+// must reach to fetch source archives. ok is false without an object store.
+func ObjectStorePeer() (peer kube.NetworkPeer, ok bool) {
+	if len(cfg.RookCephObjectStore) == 0 {
+		return peer, false
+	}
+	return kube.NetworkPeer{
+		Namespace: cfg.RookCephCluster,
+		PodLabels: map[string]string{
+			"app":               "rook-ceph-rgw",
+			"rook_object_store": cfg.RookCephObjectStore,
+		},
+	}, true
+}
+
+// sourceFormat tells tar.gz and zip archives apart by their magic bytes
+func sourceFormat(r io.Reader) (string, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return "", errors.NewBadRequest("source archive is empty or truncated")
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return SourceTarGz, nil
+	case bytes.Equal(magic, []byte("PK\x03\x04")):
+		return SourceZip, nil
+	}
+	return "", errors.NewBadRequest("source archive must be a tar.gz or zip file")
+}
+
+// withBucket calls fn with a client of each object store endpoint until one
+// succeeds. The user bucket must exist.
+func withBucket(userName string, fn func(s3client *s3.S3) error) error {
+	s3id, s3key, err := getS3Credentials(userName)
+	if err != nil {
+		return err
+	}
+	if len(s3id) == 0 || len(s3key) == 0 {
+		return errors.NewNotFound(bucketResource, userName)
+	}
+	endpoints, err := getS3Endpoints()
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		for _, addr := range ep.Endpoint {
+			endpoint := fmt.Sprintf("%s://%s", ep.Protocol, addr)
+			err = fn(util.CreateS3Client(endpoint, s3id, s3key))
+			if err == nil || errors.IsNotFound(err) || errors.IsBadRequest(err) {
+				return err
+			}
+			if util.IsNoSuchBucket(err) {
+				return errors.NewNotFound(bucketResource, userName)
+			}
+			glog.Warningf("failed to reach bucket %s at %s: %v", userName, endpoint, err)
+		}
+	}
+	return err
+}
+
+func isNotFound(err error) bool {
+	if rerr, ok := err.(awserr.RequestFailure); ok {
+		return rerr.StatusCode() == 404
+	}
+	return false
+}
@@ -30,12 +30,17 @@ import (
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 const (
 	defaultNumNodeAddr = 3
 )
 
+var (
+	bucketResource = schema.GroupResource{Group: "kubefy.io", Resource: "buckets"}
+)
+
 func CreateStorage(userName string) (bucket string, s3id string, s3key string, endpoints []model.Endpoint, err error) {
 	user := &rookceph.CephObjectStoreUser{
 		ObjectMeta: metav1.ObjectMeta{
@@ -55,52 +60,154 @@ func CreateStorage(userName string) (bucket string, s3id string, s3key string, e
 		return
 	}
 	// watch and get s3 secret
-	secretFilter := fmt.Sprintf("rook_object_store=%s,user=%s", cfg.RookCephObjectStore, userName)
-	listOpts := metav1.ListOptions{LabelSelector: secretFilter}
 	ticker := time.NewTicker(500 * time.Millisecond)
-	done := make(chan bool)
-	go func() {
-		time.Sleep(30 * time.Second)
-		done <- true
-	}()
-	for {
+	defer ticker.Stop()
+	timeout := time.After(30 * time.Second)
+	for len(s3id) == 0 || len(s3key) == 0 {
 		select {
-		case <-done:
-			break
+		case <-timeout:
+			err = fmt.Errorf("failed to find s3 credentials")
+			return
 		case <-ticker.C:
-			secrets, listErr := cfg.KubeClientset.CoreV1().Secrets(cfg.RookCephCluster).List(listOpts)
-			if listErr != nil {
-				err = listErr
+			if s3id, s3key, err = getS3Credentials(userName); err != nil {
 				return
 			}
-
-			for _, secret := range secrets.Items {
-				if key, ok := secret.Data["AccessKey"]; !ok {
-					continue
-				} else {
-					if sec, ok := secret.Data["SecretKey"]; !ok {
-						continue
-					} else {
-						s3id = string(key)
-						s3key = string(sec)
-						break
-					}
-				}
+		}
+	}
+	// get endpoint
+	if endpoints, err = getS3Endpoints(); err != nil {
+		return
+	}
+	// create bucket
+	bucket = userName
+	for _, ep := range endpoints {
+		for _, addr := range ep.Endpoint {
+			endpoint := fmt.Sprintf("%s://%s", ep.Protocol, addr)
+			s3client := util.CreateS3Client(endpoint, s3id, s3key)
+			if err = util.CreateBucket(s3client, bucket); err != nil {
+				glog.Infof("created bucket %s", bucket)
+				return
 			}
 		}
-		if len(s3id) != 0 || len(s3key) != 0 {
-			ticker.Stop()
-			break
+	}
+	return
+}
+
+// DeleteStorage empties and deletes the user bucket, then deletes the
+// CephObjectStoreUser. With dryRun set nothing is deleted.
+func DeleteStorage(userName string, dryRun bool) ([]model.ResourceStatus, error) {
+	var (
+		steps []model.ResourceStatus
+	)
+
+	cephUsers := cfg.RookClientset.CephV1().CephObjectStoreUsers(cfg.RookCephCluster)
+	if _, err := cephUsers.Get(userName, metav1.GetOptions{}); err != nil {
+		if errors.IsNotFound(err) {
+			return steps, nil
+		}
+		return steps, err
+	}
+
+	// the bucket can only be reached with the user credentials
+	bucket := userName
+	s3id, s3key, err := getS3Credentials(userName)
+	if err != nil {
+		return steps, err
+	}
+	if len(s3id) != 0 && len(s3key) != 0 {
+		step := model.ResourceStatus{Kind: "Bucket", Name: bucket}
+		if dryRun {
+			step.Status = model.StatusWouldDelete
+		} else if err = deleteBucket(bucket, s3id, s3key); err != nil {
+			step.Status = model.StatusFailed
+			step.Error = err.Error()
+			return append(steps, step), err
+		} else {
+			step.Status = model.StatusDeleted
 		}
+		steps = append(steps, step)
+	}
 
+	step := model.ResourceStatus{Kind: "CephObjectStoreUser", Namespace: cfg.RookCephCluster, Name: userName}
+	if dryRun {
+		step.Status = model.StatusWouldDelete
+	} else if err = cephUsers.Delete(userName, &metav1.DeleteOptions{}); err != nil && !errors.IsNotFound(err) {
+		step.Status = model.StatusFailed
+		step.Error = err.Error()
+		return append(steps, step), err
+	} else {
+		step.Status = model.StatusDeleted
+	}
+	return append(steps, step), nil
+}
+
+// DeleteBucket empties and deletes a bucket of the user, keeping the
+// CephObjectStoreUser so that the bucket can be created again
+func DeleteBucket(userName, bucket string) error {
+	// each user has a single bucket named after it
+	if bucket != userName {
+		return errors.NewNotFound(bucketResource, bucket)
+	}
+	s3id, s3key, err := getS3Credentials(userName)
+	if err != nil {
+		return err
 	}
 	if len(s3id) == 0 || len(s3key) == 0 {
-		err = fmt.Errorf("failed to find s3 credentials")
+		return errors.NewNotFound(bucketResource, bucket)
+	}
+	return deleteBucket(bucket, s3id, s3key)
+}
+
+// deleteBucket empties and deletes a bucket through the first reachable endpoint
+func deleteBucket(bucket, s3id, s3key string) error {
+	endpoints, err := getS3Endpoints()
+	if err != nil {
+		return err
+	}
+	for _, ep := range endpoints {
+		for _, addr := range ep.Endpoint {
+			endpoint := fmt.Sprintf("%s://%s", ep.Protocol, addr)
+			s3client := util.CreateS3Client(endpoint, s3id, s3key)
+			if err = util.EmptyBucket(s3client, bucket); err == nil {
+				err = util.DeleteBucket(s3client, bucket)
+			}
+			if err == nil || util.IsNoSuchBucket(err) {
+				glog.Infof("deleted bucket %s", bucket)
+				return nil
+			}
+			glog.Warningf("failed to delete bucket %s at %s: %v", bucket, endpoint, err)
+		}
+	}
+	return err
+}
+
+// getS3Credentials returns the s3 credentials rook generated for the user,
+// or empty strings if they are not available yet
+func getS3Credentials(userName string) (s3id string, s3key string, err error) {
+	secretFilter := fmt.Sprintf("rook_object_store=%s,user=%s", cfg.RookCephObjectStore, userName)
+	listOpts := metav1.ListOptions{LabelSelector: secretFilter}
+	secrets, err := cfg.KubeClientset.CoreV1().Secrets(cfg.RookCephCluster).List(listOpts)
+	if err != nil {
 		return
 	}
-	// get endpoint
+	for _, secret := range secrets.Items {
+		key, ok := secret.Data["AccessKey"]
+		if !ok {
+			continue
+		}
+		sec, ok := secret.Data["SecretKey"]
+		if !ok {
+			continue
+		}
+		return string(key), string(sec), nil
+	}
+	return
+}
+
+// getS3Endpoints returns the endpoints of the object store services
+func getS3Endpoints() (endpoints []model.Endpoint, err error) {
 	svcFilter := fmt.Sprintf("rook_object_store=%s", cfg.RookCephObjectStore)
-	listOpts = metav1.ListOptions{LabelSelector: svcFilter}
+	listOpts := metav1.ListOptions{LabelSelector: svcFilter}
 	glog.Info(svcFilter)
 	svcs, listErr := cfg.KubeClientset.CoreV1().Services(cfg.RookCephCluster).List(listOpts)
 	if listErr != nil {
@@ -173,17 +280,5 @@ func CreateStorage(userName string) (bucket string, s3id string, s3key string, e
 		glog.Infof("%v", err)
 		return
 	}
-	// create bucket
-	bucket = userName
-	for _, ep := range endpoints {
-		for _, addr := range ep.Endpoint {
-			endpoint := fmt.Sprintf("%s://%s", ep.Protocol, addr)
-			s3client := util.CreateS3Client(endpoint, s3id, s3key)
-			if err = util.CreateBucket(s3client, bucket); err != nil {
-				glog.Infof("created bucket %s", bucket)
-				return
-			}
-		}
-	}
 	return
 }
@@ -0,0 +1,382 @@
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package user
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/uuid"
+
+	cfg "github.com/kubefy/kubefy-server/pkg/config"
+	"github.com/kubefy/kubefy-server/pkg/kfunc"
+	"github.com/kubefy/kubefy-server/pkg/kube"
+	"github.com/kubefy/kubefy-server/pkg/model"
+	"github.com/kubefy/kubefy-server/pkg/plan"
+	"github.com/kubefy/kubefy-server/pkg/storage"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	dockerIdAnnotation = "kubefy.io/docker-id"
+	githubIdAnnotation = "kubefy.io/github-id"
+	// MaxNameLength keeps kubefy-<name>-<uuid>-ns within the 63 characters
+	// of a namespace name
+	MaxNameLength = validation.DNS1123LabelMaxLength - len("kubefy--ns") - 36 - 1
+)
+
+var (
+	// users are registered as labeled namespaces
+	userResource = schema.GroupResource{Group: "kubefy.io", Resource: "users"}
+	// serializes registration so that a user maps to one namespace
+	registerLock sync.Mutex
+)
+
+// Create registers a user and creates its namespace. An already registered
+// user is returned as is, with created set to false.
+func Create(req model.CreateUserRequest) (user *model.User, created bool, err error) {
+	if err = validateNewName(req.UserName); err != nil {
+		return
+	}
+
+	registerLock.Lock()
+	defer registerLock.Unlock()
+
+	user, err = Get(req.UserName)
+	if err == nil || !errors.IsNotFound(err) {
+		return
+	}
+
+	u, err := uuid.NewRandom()
+	if err != nil {
+		return
+	}
+	namespace := namespaceFor(req.UserName, u.String())
+	annotations := map[string]string{}
+	if len(req.DockerId) > 0 {
+		annotations[dockerIdAnnotation] = req.DockerId
+	}
+	if len(req.GithubId) > 0 {
+		annotations[githubIdAnnotation] = req.GithubId
+	}
+	if err = kube.CreateNamespace(namespace, req.UserName, annotations); err != nil {
+		return
+	}
+	glog.Infof("registered user %s in namespace %s", req.UserName, namespace)
+	// a user without quota or policies must not stay registered, a retry
+	// would find it and skip the setup
+	if err = setup(namespace, req.UserName); err != nil {
+		deleteNamespace(namespace)
+		return
+	}
+
+	user, err = Get(req.UserName)
+	created = err == nil
+	return
+}
+
+// setup applies the default plan and the network policies of a new user
+func setup(namespace, userName string) error {
+	if err := applyPlan(namespace, userName, ""); err != nil {
+		return err
+	}
+	ingressAllowlist, err := kube.ParseNetworkPeers(cfg.NetworkAllowlist)
+	if err != nil {
+		return err
+	}
+	egressAllowlist, err := kube.ParseNetworkPeers(cfg.EgressAllowlist)
+	if err != nil {
+		return err
+	}
+	// builds fetch uploaded source archives from the object store
+	if peer, ok := storage.ObjectStorePeer(); ok {
+		egressAllowlist = append(egressAllowlist, peer)
+	}
+	return kube.CreateNetworkPolicies(namespace, userName, kfunc.SystemNamespaces(), ingressAllowlist, egressAllowlist)
+}
+
+// Rollback removes a user whose registration failed after Create returned,
+// so that registering again starts over
+func Rollback(user *model.User) {
+	deleteNamespace(user.Namespace)
+}
+
+func deleteNamespace(namespace string) {
+	err := cfg.KubeClientset.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		glog.Warningf("failed to roll back namespace %s: %v", namespace, err)
+		return
+	}
+	glog.Infof("rolled back namespace %s", namespace)
+}
+
+// Get looks up a registered user by name
+func Get(name string) (*model.User, error) {
+	if err := validateName(name); err != nil {
+		return nil, err
+	}
+	listOpts := metav1.ListOptions{LabelSelector: kube.UserNameLabel + "=" + name}
+	nsList, err := cfg.KubeClientset.CoreV1().Namespaces().List(listOpts)
+	if err != nil {
+		return nil, err
+	}
+	users := fromNamespaces(nsList.Items)
+	if len(users) == 0 {
+		return nil, errors.NewNotFound(userResource, name)
+	}
+	return &users[0], nil
+}
+
+// List returns all registered users sorted by name
+func List() ([]model.User, error) {
+	listOpts := metav1.ListOptions{LabelSelector: kube.UserNameLabel}
+	nsList, err := cfg.KubeClientset.CoreV1().Namespaces().List(listOpts)
+	if err != nil {
+		return nil, err
+	}
+	return fromNamespaces(nsList.Items), nil
+}
+
+// ResolveNamespace returns the namespace of a user. For compatibility with
+// clients that kept the namespace returned by CreateUser, a kubefy namespace
+// name is accepted in place of the user name.
+func ResolveNamespace(name string) (string, error) {
+	user, err := lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return user.Namespace, nil
+}
+
+// Delete tears down a user: its functions, secrets, object storage and
+// namespace. With dryRun set the resources are listed but not deleted.
+func Delete(name string, dryRun bool) ([]model.ResourceStatus, error) {
+	var (
+		steps []model.ResourceStatus
+	)
+
+	user, err := lookup(name)
+	if err != nil {
+		return steps, err
+	}
+	namespace := user.Namespace
+
+	// report records a step and returns err so callers can bail out on failure
+	report := func(kind, ns, resName string, err error) error {
+		step := model.ResourceStatus{Kind: kind, Namespace: ns, Name: resName, Status: model.StatusDeleted}
+		if dryRun {
+			step.Status = model.StatusWouldDelete
+		}
+		if err != nil {
+			step.Status = model.StatusFailed
+			step.Error = err.Error()
+		}
+		glog.Infof("delete user %s: %s %s/%s %s", user.UserName, kind, ns, resName, step.Status)
+		steps = append(steps, step)
+		return err
+	}
+
+	// functions
+	funcs, err := kfunc.List(namespace)
+	if err != nil {
+		return steps, err
+	}
+	for _, f := range funcs {
+		var resources model.FunctionResources
+		if dryRun {
+			resources, err = kfunc.Resources(namespace, f)
+		} else {
+			resources, err = kfunc.Delete(namespace, f)
+		}
+		if err != nil && errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return steps, report("Service", namespace, f, err)
+		}
+		report("Service", namespace, resources.Service, nil)
+		for _, c := range resources.Configurations {
+			report("Configuration", namespace, c, nil)
+		}
+		for _, rev := range resources.Revisions {
+			report("Revision", namespace, rev, nil)
+		}
+		for _, b := range resources.Builds {
+			report("Build", namespace, b, nil)
+		}
+	}
+
+	// secrets created for the user
+	listOpts := metav1.ListOptions{LabelSelector: kube.UserNameLabel}
+	secrets, err := cfg.KubeClientset.CoreV1().Secrets(namespace).List(listOpts)
+	if err != nil {
+		return steps, err
+	}
+	for _, secret := range secrets.Items {
+		if !dryRun {
+			err = cfg.KubeClientset.CoreV1().Secrets(namespace).Delete(secret.Name, &metav1.DeleteOptions{})
+			if err != nil && !errors.IsNotFound(err) {
+				return steps, report("Secret", namespace, secret.Name, err)
+			}
+		}
+		report("Secret", namespace, secret.Name, nil)
+	}
+
+	// object storage is keyed by the user namespace
+	storageSteps, err := storage.DeleteStorage(namespace, dryRun)
+	steps = append(steps, storageSteps...)
+	if err != nil {
+		return steps, err
+	}
+
+	// the namespace goes last, it takes anything left behind with it
+	if !dryRun {
+		err = cfg.KubeClientset.CoreV1().Namespaces().Delete(namespace, &metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			return steps, report("Namespace", "", namespace, err)
+		}
+	}
+	report("Namespace", "", namespace, nil)
+
+	return steps, nil
+}
+
+// SetPlan moves a user to another plan and applies its quota in place
+func SetPlan(name, planName string) (*model.User, error) {
+	user, err := lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if err = applyPlan(user.Namespace, user.UserName, planName); err != nil {
+		return nil, err
+	}
+	return lookup(name)
+}
+
+// applyPlan applies a plan, or the default plan for an empty name, and
+// records it on the user namespace
+func applyPlan(namespace, userName, planName string) error {
+	p, err := plan.Get(planName)
+	if err != nil {
+		return err
+	}
+	if err = plan.Apply(namespace, userName, p); err != nil {
+		return err
+	}
+	ns, err := cfg.KubeClientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	ns.Labels[plan.PlanLabel] = p.Name
+	_, err = cfg.KubeClientset.CoreV1().Namespaces().Update(ns)
+	glog.Infof("user %s is on plan %s", userName, p.Name)
+	return err
+}
+
+// lookup finds a user by name, or by namespace for older clients
+func lookup(name string) (*model.User, error) {
+	user, err := Get(name)
+	if err == nil || !errors.IsNotFound(err) {
+		return user, err
+	}
+	ns, nsErr := cfg.KubeClientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if nsErr != nil || len(ns.Labels[kube.UserNameLabel]) == 0 {
+		return nil, err
+	}
+	users := fromNamespaces([]v1.Namespace{*ns})
+	if len(users) == 0 {
+		return nil, err
+	}
+	return &users[0], nil
+}
+
+// fromNamespaces converts user namespaces to users. Namespaces created before
+// the registry existed can map the same user more than once, in which case
+// the oldest namespace wins.
+func fromNamespaces(namespaces []v1.Namespace) []model.User {
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].CreationTimestamp.Before(&namespaces[j].CreationTimestamp)
+	})
+
+	var users []model.User
+	seen := map[string]bool{}
+	for _, ns := range namespaces {
+		name := ns.Labels[kube.UserNameLabel]
+		if len(name) == 0 || ns.Status.Phase == v1.NamespaceTerminating {
+			continue
+		}
+		if seen[name] {
+			glog.Warningf("user %s has extra namespace %s", name, ns.Name)
+			continue
+		}
+		seen[name] = true
+		users = append(users, model.User{
+			UserName:  name,
+			Namespace: ns.Name,
+			CreatedAt: ns.CreationTimestamp.UTC().Format(time.RFC3339),
+			DockerId:  ns.Annotations[dockerIdAnnotation],
+			GithubId:  ns.Annotations[githubIdAnnotation],
+			Plan:      ns.Labels[plan.PlanLabel],
+		})
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].UserName < users[j].UserName
+	})
+	return users
+}
+
+// namespaceFor returns the namespace of a new user
+func namespaceFor(name, id string) string {
+	return "kubefy-" + strings.ToLower(name) + "-" + id + "-ns"
+}
+
+// validateNewName checks that a user name can be registered, which also
+// requires a valid namespace name derived from it
+func validateNewName(name string) error {
+	if err := validateName(name); err != nil {
+		return err
+	}
+	if len(name) > MaxNameLength {
+		return errors.NewBadRequest(fmt.Sprintf("invalid user name %q: must be no more than %d characters", name, MaxNameLength))
+	}
+	namespace := namespaceFor(name, "00000000-0000-0000-0000-000000000000")
+	if errs := validation.IsDNS1123Label(namespace); len(errs) > 0 {
+		return errors.NewBadRequest(fmt.Sprintf("invalid user name %q: only letters, digits and '-' are allowed, starting and ending with a letter or digit", name))
+	}
+	return nil
+}
+
+// validateName checks a user name that is looked up, namespace names of
+// older clients included
+func validateName(name string) error {
+	if len(name) == 0 {
+		return errors.NewBadRequest("user name is missing")
+	}
+	if errs := validation.IsValidLabelValue(name); len(errs) > 0 {
+		return errors.NewBadRequest(fmt.Sprintf("invalid user name %q: %s", name, strings.Join(errs, ", ")))
+	}
+	return nil
+}
@@ -14,9 +14,12 @@
 package util
 
 import (
+	"fmt"
+
 	"github.com/golang/glog"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -91,3 +94,50 @@ func DeleteBucket(s3client *s3.S3, bucket string) error {
 	})
 	return err
 }
+
+// EmptyBucket deletes all objects in given bucket using s3 client. It walks
+// the bucket once and fails if any object could not be deleted.
+func EmptyBucket(s3client *s3.S3, bucket string) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+	}
+	for {
+		list, err := s3client.ListObjectsV2(input)
+		if err != nil {
+			return err
+		}
+		if len(list.Contents) > 0 {
+			objects := make([]*s3.ObjectIdentifier, 0, len(list.Contents))
+			for _, obj := range list.Contents {
+				objects = append(objects, &s3.ObjectIdentifier{Key: obj.Key})
+			}
+			out, err := s3client.DeleteObjects(&s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket),
+				Delete: &s3.Delete{
+					Objects: objects,
+					Quiet:   aws.Bool(true),
+				},
+			})
+			if err != nil {
+				return err
+			}
+			if len(out.Errors) > 0 {
+				e := out.Errors[0]
+				return fmt.Errorf("failed to delete %d objects of bucket %s, %s: %s",
+					len(out.Errors), bucket, aws.StringValue(e.Key), aws.StringValue(e.Message))
+			}
+		}
+		if !aws.BoolValue(list.IsTruncated) {
+			return nil
+		}
+		input.ContinuationToken = list.NextContinuationToken
+	}
+}
+
+// IsNoSuchBucket returns true if err reports a missing bucket
+func IsNoSuchBucket(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code() == s3.ErrCodeNoSuchBucket
+	}
+	return false
+}